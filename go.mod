@@ -1,9 +1,3 @@
 module gocog
 
 go 1.20
-
-require (
-	github.com/airbusgeo/godal v0.0.7 // indirect
-	github.com/terrascope/gocog v0.0.0-20180610141759-8c76e7f84b41 // indirect
-	github.com/terrascope/scimage v0.0.0-20200814045938-7a5e784411e8 // indirect
-)
@@ -0,0 +1,277 @@
+package gocog
+
+import (
+	"fmt"
+	"image"
+	"io"
+)
+
+// COG is a handle on an opened Cloud Optimised GeoTIFF. The header and all
+// IFDs are read once by Open; subsequent calls only read the pixel data they
+// need. A COG may be used from several goroutines at once, provided the
+// underlying io.ReaderAt supports parallel ReadAt calls.
+type COG struct {
+	d    decoder
+	opts OpenOptions
+}
+
+// DefaultParallelism is the number of tiles a COG reads and decompresses at
+// once unless its OpenOptions say otherwise.
+const DefaultParallelism = 8
+
+// OpenOptions configures a COG. The zero value is usable.
+type OpenOptions struct {
+	// Parallelism is the number of tiles read and decompressed at once when
+	// decoding an image. If zero, DefaultParallelism is used; 1 decodes one
+	// tile after the other. Values above 1 require an io.ReaderAt that
+	// supports parallel ReadAt calls.
+	Parallelism int
+}
+
+// Open reads the header and the IFDs of every level from ra and returns a
+// COG that can be used to decode any number of images from it.
+func Open(ra io.ReaderAt) (*COG, error) {
+	return OpenWithOptions(ra, OpenOptions{})
+}
+
+// OpenWithOptions is Open, configured by opts.
+func OpenWithOptions(ra io.ReaderAt, opts OpenOptions) (*COG, error) {
+	if opts.Parallelism <= 0 {
+		opts.Parallelism = DefaultParallelism
+	}
+	d, err := newDecoderAt(ra)
+	if err != nil {
+		return nil, err
+	}
+	err = d.readIFD()
+	if err != nil {
+		return nil, err
+	}
+	if len(d.gt.Overviews) == 0 {
+		return nil, FormatError("no image found")
+	}
+
+	return &COG{d: d, opts: opts}, nil
+}
+
+// Levels returns the number of levels in the file: the full resolution image
+// followed by its overviews.
+func (c *COG) Levels() int {
+	return len(c.d.gt.Overviews)
+}
+
+// Level returns the description of the image at the given level.
+func (c *COG) Level(level int) (ImgDesc, error) {
+	if err := c.checkLevel(level); err != nil {
+		return ImgDesc{}, err
+	}
+	return c.d.gt.Overviews[level], nil
+}
+
+// GeoTIFF returns the parsed GeoTIFF metadata of the file.
+func (c *COG) GeoTIFF() GeoTIFF {
+	return c.d.gt
+}
+
+// GeoInfo returns the same information as DecodeGeoInfo.
+func (c *COG) GeoInfo() (GeoInfo, error) {
+	return c.d.geoInfo()
+}
+
+// Config returns the color model and dimensions of the image at the given
+// level.
+func (c *COG) Config(level int) (image.Config, error) {
+	if err := c.checkLevel(level); err != nil {
+		return image.Config{}, err
+	}
+	return c.d.config(level), nil
+}
+
+// DecodeLevel decodes the whole image at the given level.
+func (c *COG) DecodeLevel(level int) (image.Image, error) {
+	if err := c.checkLevel(level); err != nil {
+		return nil, err
+	}
+	cfg := c.d.gt.Overviews[level]
+	rect := image.Rect(0, 0, int(cfg.ImageWidth), int(cfg.ImageHeight))
+
+	return decodeLevelSubImage(c.d, level, rect, c.opts.Parallelism)
+}
+
+// DecodeLevelSubImage decodes the part of the image at the given level that
+// falls within rect.
+func (c *COG) DecodeLevelSubImage(level int, rect image.Rectangle) (image.Image, error) {
+	if err := c.checkLevel(level); err != nil {
+		return nil, err
+	}
+	return decodeLevelSubImage(c.d, level, rect, c.opts.Parallelism)
+}
+
+// ReadRaster decodes the part of the image at the given level that falls
+// within rect into a Raster, which gives access to every band whatever the
+// number of samples per pixel. If bands are given, the Raster holds only
+// these bands, in the given order, counting from 0. Of band-separate images,
+// only the tiles of these bands are read.
+func (c *COG) ReadRaster(level int, rect image.Rectangle, bands ...int) (*Raster, error) {
+	if err := c.checkLevel(level); err != nil {
+		return nil, err
+	}
+	return readRaster(c.d, level, rect, bands, c.opts.Parallelism)
+}
+
+// ReadRasterInto decodes the part of the image at the given level that dst
+// covers into dst, reusing its memory instead of allocating a new Raster. dst
+// must have the DataType of the image and as many bands as are read: the
+// given bands, or all bands of the image if there are none. Pixels of dst
+// outside the image are left alone.
+func (c *COG) ReadRasterInto(level int, dst *Raster, bands ...int) error {
+	if err := c.checkLevel(level); err != nil {
+		return err
+	}
+	return readRasterInto(c.d, level, dst, bands, c.opts.Parallelism)
+}
+
+// ReadInto decodes the given bands of the part of the image at the given
+// level that falls within rect into dst, or all bands if bands is nil. dst
+// receives the samples converted to T, row by row with the samples of each
+// pixel following each other band by band, and must hold at least
+// rect.Dx()*rect.Dy()*len(bands) of them. Samples of pixels outside the image
+// are left alone.
+//
+// ReadInto allocates no memory for the pixels once it has been called a few
+// times, which keeps the load on the garbage collector flat when serving
+// many tiles.
+func ReadInto[T Sample](c *COG, level int, rect image.Rectangle, bands []int, dst []T) error {
+	if err := c.checkLevel(level); err != nil {
+		return err
+	}
+	cfg := c.d.gt.Overviews[level]
+	imgRect, err := subImageRect(cfg, rect)
+	if err != nil {
+		return err
+	}
+	dt, err := rasterDataType(cfg)
+	if err != nil {
+		return err
+	}
+	bands, err = rasterBands(cfg, bands)
+	if err != nil {
+		return err
+	}
+	nb := len(bands)
+	if n := rect.Dx() * rect.Dy() * nb; len(dst) < n {
+		return fmt.Errorf("buffer holds %d samples, needs %d", len(dst), n)
+	}
+
+	sc := getScratch()
+	defer putScratch(sc)
+	r := &Raster{Rect: imgRect, Bands: nb, DataType: dt, Stride: imgRect.Dx() * nb * dt.Size()}
+	sc.pix = grow(sc.pix, imgRect.Dy()*r.Stride)
+	r.Pix = sc.pix
+	if err := readRasterInto(c.d, level, r, bands, c.opts.Parallelism); err != nil {
+		return err
+	}
+
+	n := imgRect.Dx() * nb
+	for y := imgRect.Min.Y; y < imgRect.Max.Y; y++ {
+		i := ((y-rect.Min.Y)*rect.Dx() + imgRect.Min.X - rect.Min.X) * nb
+		convertSamples(dst[i:i+n], r.Pix[(y-imgRect.Min.Y)*r.Stride:], dt, 1)
+	}
+	return nil
+}
+
+// TileCount returns the number of tile columns and rows of the image at the
+// given level. The strips of a stripped image are exposed as tiles spanning
+// the whole width of the image, one per row.
+func (c *COG) TileCount(level int) (cols, rows int, err error) {
+	if err := c.checkLevel(level); err != nil {
+		return 0, 0, err
+	}
+	cols, rows = tileGrid(c.d.gt.Overviews[level])
+	return cols, rows, nil
+}
+
+// TileBounds returns the part of the image at the given level covered by the
+// tile in column col and row row. Tiles at the right and bottom edges may
+// extend beyond the image; their bounds are clipped to it.
+func (c *COG) TileBounds(level, col, row int) (image.Rectangle, error) {
+	if err := c.checkTile(level, col, row); err != nil {
+		return image.Rectangle{}, err
+	}
+	cfg := c.d.gt.Overviews[level]
+	w, h := int(cfg.TileWidth), int(cfg.TileHeight)
+	bounds := image.Rect(col*w, row*h, (col+1)*w, (row+1)*h)
+	return bounds.Intersect(image.Rect(0, 0, int(cfg.ImageWidth), int(cfg.ImageHeight))), nil
+}
+
+// RawTile returns the data of a tile as stored in the file, together with
+// the compression it is stored with, one of the Compression values of TIFF.
+// Tiles the file leaves out, which GDAL writes for sparse images, are
+// returned as empty data. Images whose PlanarConfiguration is 2 store each
+// band in tiles of its own; band selects which of them is returned, and must
+// be 0 for other images.
+func (c *COG) RawTile(level, col, row, band int) (data []byte, compression uint16, err error) {
+	if err := c.checkTile(level, col, row); err != nil {
+		return nil, 0, err
+	}
+	cfg := c.d.gt.Overviews[level]
+	bands := 1
+	if cfg.PlanarConfiguration == 2 {
+		bands = int(cfg.SamplesPerPixel)
+	}
+	if band < 0 || band >= bands {
+		return nil, 0, fmt.Errorf("band %d not stored in tiles of its own in level %d", band, level)
+	}
+	cols, rows := tileGrid(cfg)
+	k := band*cols*rows + row*cols + col
+	if k >= len(cfg.TileOffsets) || k >= len(cfg.TileByteCounts) {
+		return nil, 0, FormatError("inconsistent header")
+	}
+	data = make([]byte, cfg.TileByteCounts[k])
+	if len(data) > 0 {
+		if _, err := c.d.ra.ReadAt(data, int64(cfg.TileOffsets[k])); err != nil {
+			return nil, 0, err
+		}
+	}
+	return data, cfg.Compression, nil
+}
+
+// DecodeTile decodes a single tile of the image at the given level. The
+// result covers TileBounds(level, col, row). A tile the file leaves out is
+// decoded as all NoData, or zero if the image has none.
+func (c *COG) DecodeTile(level, col, row int) (image.Image, error) {
+	bounds, err := c.TileBounds(level, col, row)
+	if err != nil {
+		return nil, err
+	}
+	return decodeLevelSubImage(c.d, level, bounds, 1)
+}
+
+func (c *COG) checkTile(level, col, row int) error {
+	cols, rows, err := c.TileCount(level)
+	if err != nil {
+		return err
+	}
+	if col < 0 || col >= cols || row < 0 || row >= rows {
+		return fmt.Errorf("tile %d,%d not in level %d", col, row, level)
+	}
+	return nil
+}
+
+// tileGrid returns the number of tile columns and rows of cfg, or zeroes if
+// it is not tiled.
+func tileGrid(cfg ImgDesc) (cols, rows int) {
+	if cfg.TileWidth == 0 || cfg.TileHeight == 0 {
+		return 0, 0
+	}
+	cols = int((cfg.ImageWidth + cfg.TileWidth - 1) / cfg.TileWidth)
+	rows = int((cfg.ImageHeight + cfg.TileHeight - 1) / cfg.TileHeight)
+	return cols, rows
+}
+
+func (c *COG) checkLevel(level int) error {
+	if level < 0 || level >= len(c.d.gt.Overviews) {
+		return fmt.Errorf("level %d not in this geotiff", level)
+	}
+	return nil
+}
@@ -0,0 +1,521 @@
+package gocog
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// The fixtures in testdata are 50x40 images in tiles of 32x32 pixels, or in
+// strips if their name says so, written by testfiles/makefixtures.py. Each <name>.tif comes with <name>.raw, the
+// samples libtiff decodes from it.
+const fixtureWidth, fixtureHeight = 50, 40
+
+// openFixture opens testdata/<name>.tif and returns it together with the
+// samples of <name>.raw.
+func openFixture(t *testing.T, name string) (*COG, []byte) {
+	t.Helper()
+	f, err := os.Open(filepath.Join("testdata", name+".tif"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	c, err := Open(f)
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	want, err := os.ReadFile(filepath.Join("testdata", name+".raw"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, want
+}
+
+func TestReadRasterIntoOutsideImage(t *testing.T) {
+	const sentinel = 0xabab
+	c, want := openFixture(t, "uint16_none")
+
+	// dst reaches past the right and bottom edges of the image, into the
+	// padding of the tiles there.
+	dst := NewRaster(image.Rect(40, 30, 64, 64), 1, UInt16)
+	for y := dst.Rect.Min.Y; y < dst.Rect.Max.Y; y++ {
+		for x := dst.Rect.Min.X; x < dst.Rect.Max.X; x++ {
+			dst.SetFloat64(0, x, y, sentinel)
+		}
+	}
+	if err := c.ReadRasterInto(0, dst); err != nil {
+		t.Fatal(err)
+	}
+	for y := dst.Rect.Min.Y; y < dst.Rect.Max.Y; y++ {
+		for x := dst.Rect.Min.X; x < dst.Rect.Max.X; x++ {
+			got := SampleAt[uint16](dst, 0, x, y)
+			if x >= fixtureWidth || y >= fixtureHeight {
+				if got != sentinel {
+					t.Fatalf("pixel (%d,%d) outside the image was overwritten with %#x", x, y, got)
+				}
+				continue
+			}
+			if w := binary.LittleEndian.Uint16(want[2*(y*fixtureWidth+x):]); got != w {
+				t.Fatalf("pixel (%d,%d) = %d, want %d", x, y, got, w)
+			}
+		}
+	}
+}
+
+func TestReadIntoOutsideImage(t *testing.T) {
+	const sentinel = -1
+	c, want := openFixture(t, "uint16_none")
+
+	rect := image.Rect(45, 35, 60, 50)
+	dst := make([]int32, rect.Dx()*rect.Dy())
+	for i := range dst {
+		dst[i] = sentinel
+	}
+	if err := ReadInto(c, 0, rect, nil, dst); err != nil {
+		t.Fatal(err)
+	}
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			got := dst[(y-rect.Min.Y)*rect.Dx()+x-rect.Min.X]
+			w := int32(sentinel)
+			if x < fixtureWidth && y < fixtureHeight {
+				w = int32(binary.LittleEndian.Uint16(want[2*(y*fixtureWidth+x):]))
+			}
+			if got != w {
+				t.Fatalf("pixel (%d,%d) = %d, want %d", x, y, got, w)
+			}
+		}
+	}
+}
+
+// rawSample returns sample i of the samples in raw, which are of type t.
+func rawSample(raw []byte, t DataType, i int) float64 {
+	r := Raster{Rect: image.Rect(0, 0, len(raw)/t.Size(), 1), Bands: 1, DataType: t, Pix: raw}
+	return r.Float64At(0, i, 0)
+}
+
+func TestDecodeFixtures(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		bands    int
+		dataType DataType
+	}{
+		{"uint16_none", 1, UInt16},
+		{"uint8_lerc", 4, UInt8},
+		{"int16_lerc", 1, Int16},
+		{"uint16_lerc", 1, UInt16},
+		{"int32_lerc", 1, Int32},
+		{"float32_lerc", 1, Float32},
+		{"float64_lerc", 1, Float64},
+		{"uint8_lerc_deflate", 4, UInt8},
+		{"int16_lerc_deflate", 1, Int16},
+		{"uint16_lerc_deflate", 1, UInt16},
+		{"int32_lerc_deflate", 1, Int32},
+		{"float32_lerc_deflate", 1, Float32},
+		{"float64_lerc_deflate", 1, Float64},
+		{"uint8_lerc_zstd", 4, UInt8},
+		{"int16_lerc_zstd", 1, Int16},
+		{"uint16_lerc_zstd", 1, UInt16},
+		{"int32_lerc_zstd", 1, Int32},
+		{"float32_lerc_zstd", 1, Float32},
+		{"float64_lerc_zstd", 1, Float64},
+		{"float32_lerc_lossy", 1, Float32},
+		{"int16_lerc_lossy", 1, Int16},
+		{"uint8_zstd", 4, UInt8},
+		{"int16_zstd", 1, Int16},
+		{"uint16_zstd", 1, UInt16},
+		{"int32_zstd", 1, Int32},
+		{"float32_zstd", 1, Float32},
+		{"float64_zstd", 1, Float64},
+		{"uint16_strips", 1, UInt16},
+		{"int16_strips_lzw", 1, Int16},
+		{"uint8_strips_deflate", 3, UInt8},
+		{"float32_strips_rows", 1, Float32},
+		{"uint16_strip", 1, UInt16},
+		{"uint16_bigtiff", 3, UInt16},
+		{"uint16_bigtiff_be", 3, UInt16},
+		{"int16_bigtiff_be_deflate", 1, Int16},
+		{"uint16_planar", 3, UInt16},
+		{"uint8_planar_strips", 3, UInt8},
+		{"gray1", 1, UInt8},
+		{"gray2", 1, UInt8},
+		{"gray4", 1, UInt8},
+		{"gray1_whiteiszero", 1, UInt8},
+		{"palette4", 1, UInt8},
+		{"palette8_be", 1, UInt8},
+		{"uint16_be", 1, UInt16},
+		{"float32_be_strips", 1, Float32},
+		{"uint16_whiteiszero_be", 1, UInt16},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			c, want := openFixture(t, test.name)
+			r, err := c.ReadRaster(0, image.Rect(0, 0, fixtureWidth, fixtureHeight))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.Bands != test.bands || r.DataType != test.dataType {
+				t.Fatalf("got %d bands of %v, want %d bands of %v", r.Bands, r.DataType, test.bands, test.dataType)
+			}
+			for y := 0; y < fixtureHeight; y++ {
+				for x := 0; x < fixtureWidth; x++ {
+					for b := 0; b < r.Bands; b++ {
+						got := r.Float64At(b, x, y)
+						w := rawSample(want, r.DataType, (y*fixtureWidth+x)*r.Bands+b)
+						if got != w && !(math.IsNaN(got) && math.IsNaN(w)) {
+							t.Fatalf("band %d at (%d,%d) = %v, want %v", b, x, y, got, w)
+						}
+					}
+				}
+			}
+		})
+	}
+}
+
+// failingReaderAt fails every read with err.
+type failingReaderAt struct{ err error }
+
+func (r failingReaderAt) ReadAt(p []byte, off int64) (int, error) { return 0, r.err }
+
+func TestOpenReadError(t *testing.T) {
+	errRead := errors.New("range requests not supported")
+	if _, err := Open(failingReaderAt{errRead}); !errors.Is(err, errRead) {
+		t.Errorf("Open of a failing reader: got %v, want %v", err, errRead)
+	}
+	var fe FormatError
+	if _, err := Open(bytes.NewReader([]byte("II*"))); !errors.As(err, &fe) {
+		t.Errorf("Open of a truncated header: got %v, want a FormatError", err)
+	}
+}
+
+func TestTiles(t *testing.T) {
+	c, want := openFixture(t, "uint16_sparse")
+	if cols, rows, err := c.TileCount(0); err != nil || cols != 2 || rows != 2 {
+		t.Fatalf("TileCount = %d, %d, %v, want 2, 2", cols, rows, err)
+	}
+
+	for _, test := range []struct {
+		col, row int
+		bounds   image.Rectangle
+		sparse   bool
+	}{
+		{0, 0, image.Rect(0, 0, 32, 32), false},
+		{1, 0, image.Rect(32, 0, 50, 32), true},
+		{0, 1, image.Rect(0, 32, 32, 40), false},
+		{1, 1, image.Rect(32, 32, 50, 40), false},
+	} {
+		bounds, err := c.TileBounds(0, test.col, test.row)
+		if err != nil || bounds != test.bounds {
+			t.Errorf("TileBounds(%d, %d) = %v, %v, want %v", test.col, test.row, bounds, err, test.bounds)
+			continue
+		}
+
+		// The tiles are stored uncompressed, padded to 32x32 at the edges.
+		data, compression, err := c.RawTile(0, test.col, test.row, 0)
+		if err != nil || compression != 1 {
+			t.Fatalf("RawTile(%d, %d) = %v, compression %d", test.col, test.row, err, compression)
+		}
+		if test.sparse {
+			if len(data) != 0 {
+				t.Errorf("RawTile(%d, %d) of a tile left out = %d bytes", test.col, test.row, len(data))
+			}
+		} else if len(data) != 32*32*2 {
+			t.Errorf("RawTile(%d, %d) = %d bytes, want %d", test.col, test.row, len(data), 32*32*2)
+		} else {
+			for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+				for x := bounds.Min.X; x < bounds.Max.X; x++ {
+					i := 2 * ((y-bounds.Min.Y)*32 + x - bounds.Min.X)
+					if got, w := binary.LittleEndian.Uint16(data[i:]), binary.LittleEndian.Uint16(want[2*(y*fixtureWidth+x):]); got != w {
+						t.Fatalf("RawTile(%d, %d): pixel (%d,%d) = %d, want %d", test.col, test.row, x, y, got, w)
+					}
+				}
+			}
+		}
+
+		img, err := c.DecodeTile(0, test.col, test.row)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if img.Bounds() != test.bounds {
+			t.Errorf("DecodeTile(%d, %d) covers %v, want %v", test.col, test.row, img.Bounds(), test.bounds)
+		}
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				got := color.Gray16Model.Convert(img.At(x, y)).(color.Gray16).Y
+				if w := binary.LittleEndian.Uint16(want[2*(y*fixtureWidth+x):]); got != w {
+					t.Fatalf("DecodeTile(%d, %d): pixel (%d,%d) = %d, want %d", test.col, test.row, x, y, got, w)
+				}
+			}
+		}
+	}
+
+	for _, tile := range [][3]int{{0, 2, 0}, {0, 0, -1}, {1, 0, 0}} {
+		if _, err := c.TileBounds(tile[0], tile[1], tile[2]); err == nil {
+			t.Errorf("TileBounds(%d, %d, %d) of a tile that does not exist succeeded", tile[0], tile[1], tile[2])
+		}
+	}
+	if _, _, err := c.RawTile(0, 0, 0, 1); err == nil {
+		t.Error("RawTile of band 1 of a pixel-interleaved image succeeded")
+	}
+}
+
+func TestStrips(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		rows      int // of strips
+		lastStrip image.Rectangle
+	}{
+		{"uint16_strips", 3, image.Rect(0, 32, 50, 40)},
+		{"int16_strips_lzw", 3, image.Rect(0, 32, 50, 40)},
+		{"uint8_strips_deflate", 3, image.Rect(0, 32, 50, 40)},
+		{"float32_strips_rows", 40, image.Rect(0, 39, 50, 40)},
+		{"uint16_strip", 1, image.Rect(0, 0, 50, 40)},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			c, want := openFixture(t, test.name)
+			if cfg, _ := c.Level(0); !cfg.Stripped {
+				t.Error("image is not taken as stripped")
+			}
+			cols, rows, err := c.TileCount(0)
+			if err != nil || cols != 1 || rows != test.rows {
+				t.Fatalf("TileCount = %d, %d, %v, want 1, %d", cols, rows, err, test.rows)
+			}
+			bounds, err := c.TileBounds(0, 0, rows-1)
+			if err != nil || bounds != test.lastStrip {
+				t.Errorf("TileBounds of the last strip = %v, %v, want %v", bounds, err, test.lastStrip)
+			}
+
+			// A part of the image across strips.
+			rect := image.Rect(3, 10, 47, 35)
+			r, err := c.ReadRaster(0, rect)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for y := rect.Min.Y; y < rect.Max.Y; y++ {
+				for x := rect.Min.X; x < rect.Max.X; x++ {
+					for b := 0; b < r.Bands; b++ {
+						got := r.Float64At(b, x, y)
+						w := rawSample(want, r.DataType, (y*fixtureWidth+x)*r.Bands+b)
+						if got != w && !(math.IsNaN(got) && math.IsNaN(w)) {
+							t.Fatalf("band %d at (%d,%d) = %v, want %v", b, x, y, got, w)
+						}
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestMissingBitsPerSample(t *testing.T) {
+	// Without BitsPerSample, samples are of a single bit.
+	c, want := openFixture(t, "bilevel_nobps")
+	if cfg, _ := c.Level(0); len(cfg.BitsPerSample) != 1 || cfg.BitsPerSample[0] != 1 {
+		t.Fatalf("BitsPerSample = %v, want [1]", cfg.BitsPerSample)
+	}
+	r, err := c.ReadRaster(0, image.Rect(0, 0, fixtureWidth, fixtureHeight))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Bands != 1 || r.DataType != UInt8 || !bytes.Equal(r.Pix, want) {
+		t.Errorf("got %d bands of %v, want the samples of a bilevel image", r.Bands, r.DataType)
+	}
+	if _, err := c.DecodeLevel(0); err != nil {
+		t.Error(err)
+	}
+	c.GeoInfo() // used to index BitsPerSample out of range
+
+	var fe FormatError
+	f, err := os.Open(filepath.Join("testdata", "uint8_bps_count.tif"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := Open(f); !errors.As(err, &fe) {
+		t.Errorf("BitsPerSample of 2 samples for 3: got %v, want a FormatError", err)
+	}
+}
+
+// recordingReaderAt remembers the [start, length] spans read from it.
+type recordingReaderAt struct {
+	ra    io.ReaderAt
+	mu    sync.Mutex
+	spans [][2]int64
+}
+
+func (r *recordingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	r.mu.Lock()
+	r.spans = append(r.spans, [2]int64{off, int64(len(p))})
+	r.mu.Unlock()
+	return r.ra.ReadAt(p, off)
+}
+
+func TestPlanarBands(t *testing.T) {
+	for _, name := range []string{"uint16_planar", "uint8_planar_strips"} {
+		t.Run(name, func(t *testing.T) {
+			_, want := openFixture(t, name)
+			f, err := os.Open(filepath.Join("testdata", name+".tif"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			rec := &recordingReaderAt{ra: f}
+			c, err := Open(rec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cfg, _ := c.Level(0)
+			cols, rows, _ := c.TileCount(0)
+			if cfg.PlanarConfiguration != 2 || len(cfg.TileOffsets) != 3*cols*rows {
+				t.Fatalf("PlanarConfiguration %d with %d tiles", cfg.PlanarConfiguration, len(cfg.TileOffsets))
+			}
+
+			// The tiles of each band are found by RawTile.
+			for band := 0; band < 3; band++ {
+				data, _, err := c.RawTile(0, 0, 0, band)
+				if err != nil || len(data) != int(cfg.TileByteCounts[band*cols*rows]) {
+					t.Errorf("RawTile of band %d = %d bytes, %v", band, len(data), err)
+				}
+			}
+
+			rec.mu.Lock()
+			rec.spans = nil
+			rec.mu.Unlock()
+			r, err := c.ReadRaster(0, image.Rect(0, 0, fixtureWidth, fixtureHeight), 2, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for y := 0; y < fixtureHeight; y++ {
+				for x := 0; x < fixtureWidth; x++ {
+					for i, b := range []int{2, 0} {
+						got := r.Float64At(i, x, y)
+						if w := rawSample(want, r.DataType, (y*fixtureWidth+x)*3+b); got != w {
+							t.Fatalf("band %d at (%d,%d) = %v, want %v", b, x, y, got, w)
+						}
+					}
+				}
+			}
+
+			// Only the tiles of bands 0 and 2 are read.
+			if len(rec.spans) == 0 {
+				t.Fatal("no tiles were read")
+			}
+			for _, span := range rec.spans {
+				for k, off := range cfg.TileOffsets {
+					end := int64(off + cfg.TileByteCounts[k])
+					if band := k / (cols * rows); band == 1 && span[0] < end && int64(off) < span[0]+span[1] {
+						t.Errorf("read %d bytes at %d, within tile %d of band 1", span[1], span[0], k)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestDecodeImages(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		// want returns the color of a pixel whose sample is v.
+		want func(cfg ImgDesc, v uint8) color.Color
+	}{
+		{"gray1", func(cfg ImgDesc, v uint8) color.Color { return color.Gray{v * 255} }},
+		{"gray2", func(cfg ImgDesc, v uint8) color.Color { return color.Gray{v * 85} }},
+		{"gray4", func(cfg ImgDesc, v uint8) color.Color { return color.Gray{v * 17} }},
+		{"gray1_whiteiszero", func(cfg ImgDesc, v uint8) color.Color { return color.Gray{255 - v*255} }},
+		{"palette4", func(cfg ImgDesc, v uint8) color.Color {
+			return color.RGBA64{cfg.ColorMap[v], cfg.ColorMap[16+int(v)], cfg.ColorMap[32+int(v)], 0xffff}
+		}},
+		{"palette8_be", func(cfg ImgDesc, v uint8) color.Color {
+			return color.RGBA64{cfg.ColorMap[v], cfg.ColorMap[256+int(v)], cfg.ColorMap[512+int(v)], 0xffff}
+		}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			c, want := openFixture(t, test.name)
+			cfg, _ := c.Level(0)
+			img, err := c.DecodeLevel(0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if model, _ := c.Config(0); model.ColorModel == nil {
+				t.Error("Config has no color model")
+			}
+			switch img.(type) {
+			case *image.Gray:
+				if cfg.PhotometricInterpr == 3 {
+					t.Errorf("paletted image decoded as %T", img)
+				}
+			case *image.Paletted:
+				if cfg.PhotometricInterpr != 3 {
+					t.Errorf("gray image decoded as %T", img)
+				}
+			default:
+				t.Fatalf("decoded as %T", img)
+			}
+			for y := 0; y < fixtureHeight; y++ {
+				for x := 0; x < fixtureWidth; x++ {
+					v := want[y*fixtureWidth+x]
+					r0, g0, b0, a0 := img.At(x, y).RGBA()
+					r1, g1, b1, a1 := test.want(cfg, v).RGBA()
+					if r0 != r1 || g0 != g1 || b0 != b1 || a0 != a1 {
+						t.Fatalf("pixel (%d,%d) of sample %d = %v, want %v", x, y, v, img.At(x, y), test.want(cfg, v))
+					}
+				}
+			}
+
+			// The samples of a Raster stay as they are when it is turned into
+			// an image.
+			r, err := c.ReadRaster(0, image.Rect(0, 0, fixtureWidth, fixtureHeight))
+			if err != nil {
+				t.Fatal(err)
+			}
+			rasterImage(r, cfg)
+			if !bytes.Equal(r.Pix, want) {
+				t.Error("rasterImage changed the samples of the Raster")
+			}
+		})
+	}
+}
+
+func TestDecodeWhiteIsZero16(t *testing.T) {
+	c, want := openFixture(t, "uint16_whiteiszero_be")
+	img, err := c.DecodeLevel(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gray, ok := img.(*image.Gray16)
+	if !ok {
+		t.Fatalf("decoded as %T, want *image.Gray16", img)
+	}
+	for y := 0; y < fixtureHeight; y++ {
+		for x := 0; x < fixtureWidth; x++ {
+			v := binary.LittleEndian.Uint16(want[2*(y*fixtureWidth+x):])
+			if got := gray.Gray16At(x, y).Y; got != 0xffff-v {
+				t.Fatalf("pixel (%d,%d) of sample %d = %d, want %d", x, y, v, got, 0xffff-v)
+			}
+		}
+	}
+}
+
+func TestPutScratch(t *testing.T) {
+	s := &scratch{
+		raw:  make([]byte, maxPooledRaw+1),
+		data: make([]byte, maxPooledRaw+1),
+		tmp:  make([]byte, maxPooledRaw+1),
+		pix:  make([]byte, maxPooledRaw+1),
+	}
+	putScratch(s)
+	if s.raw != nil || s.data != nil || s.tmp != nil || s.pix != nil {
+		t.Error("buffers larger than maxPooledRaw are kept in the pool")
+	}
+	s = &scratch{raw: make([]byte, 10), pix: make([]byte, maxPooledRaw)}
+	putScratch(s)
+	if s.raw == nil || s.pix == nil {
+		t.Error("small buffers are not kept in the pool")
+	}
+}
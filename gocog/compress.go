@@ -14,14 +14,13 @@ type byteReader interface {
 	io.ByteReader
 }
 
-// unpackBits decodes the PackBits-compressed data in src and returns the
-// uncompressed data.
+// unpackBits decodes the PackBits-compressed data in r and returns the
+// uncompressed data, appended to dst[:0] so that its memory can be reused.
 //
 // The PackBits compression format is described in section 9 (p. 42)
 // of the TIFF spec.
-func unpackBits(r io.Reader) ([]byte, error) {
-	buf := make([]byte, 128)
-	dst := make([]byte, 0, 1024)
+func unpackBits(dst []byte, r io.Reader) ([]byte, error) {
+	dst = dst[:0]
 	br, ok := r.(byteReader)
 	if !ok {
 		br = bufio.NewReader(r)
@@ -38,11 +37,11 @@ func unpackBits(r io.Reader) ([]byte, error) {
 		code := int(int8(b))
 		switch {
 		case code >= 0:
-			n, err := io.ReadFull(br, buf[:code+1])
-			if err != nil {
+			n := len(dst)
+			dst = append(dst, make([]byte, code+1)...)
+			if _, err := io.ReadFull(br, dst[n:]); err != nil {
 				return nil, err
 			}
-			dst = append(dst, buf[:n]...)
 		case code == -128:
 			// No-op.
 		default:
@@ -50,9 +49,8 @@ func unpackBits(r io.Reader) ([]byte, error) {
 				return nil, err
 			}
 			for j := 0; j < 1-code; j++ {
-				buf[j] = b
+				dst = append(dst, b)
 			}
-			dst = append(dst, buf[:1-code]...)
 		}
 	}
 }
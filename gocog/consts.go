@@ -14,12 +14,19 @@ package gocog
 //  - the data itself or a pointer to it if it is more than 4 bytes.
 //
 // The presence of a length means that each IFD is effectively an array.
+//
+// BigTIFF files use 8 bytes for counts and offsets, which makes IFD entries
+// 20 bytes long and lets them hold up to 8 bytes of data themselves.
 
 const (
 	leHeader = "II\x2A\x00" // Header for little-endian files.
 	beHeader = "MM\x00\x2A" // Header for big-endian files.
 
-	ifdLen = 12 // Length of an IFD entry in bytes.
+	leBigHeader = "II\x2B\x00" // Header for little-endian BigTIFF files.
+	beBigHeader = "MM\x00\x2B" // Header for big-endian BigTIFF files.
+
+	ifdLen    = 12 // Length of an IFD entry in bytes.
+	bigIfdLen = 20 // Length of a BigTIFF IFD entry in bytes.
 )
 
 // Data types (p. 14-16 of the spec).
@@ -36,10 +43,14 @@ const (
 	dtSRational = 10
 	dtFloat32   = 11
 	dtFloat64   = 12
+	dtIFD       = 13
+	dtLong8     = 16 // BigTIFF only.
+	dtSLong8    = 17 // BigTIFF only.
+	dtIFD8      = 18 // BigTIFF only.
 )
 
 // The length of one instance of each data type in bytes.
-var lengths = [...]uint32{0, 1, 1, 2, 4, 8, 1, 0, 2, 4, 8, 4, 8}
+var lengths = [...]uint32{0, 1, 1, 2, 4, 8, 1, 0, 2, 4, 8, 4, 8, 4, 0, 0, 8, 8, 8}
 
 const (
 	cNewSubfileType      = 254
@@ -48,15 +59,20 @@ const (
 	cBitsPerSample       = 258
 	cCompression         = 259
 	cPhotometricInterpr  = 262
+	cStripOffsets        = 273
 	cSamplesPerPixel     = 277
+	cRowsPerStrip        = 278
+	cStripByteCounts     = 279
 	cPlanarConfiguration = 284
 
 	cPredictor    = 317
+	cColorMap     = 320
 
 	cTileWidth           = 322
 	cTileLength          = 323
 	cTileOffsets         = 324
 	cTileByteCounts      = 325
+	cExtraSamples        = 338
 	cSampleFormat        = 339
 )
 
@@ -64,8 +80,9 @@ const (
 
 const (
 	// GDAL tags
-	tGDALMetadata = 42112
-	tGDALNoData   = 42113
+	tGDALMetadata   = 42112
+	tGDALNoData     = 42113
+	tLercParameters = 50674 // LERC version and additional compression.
 
 	// GeoTIFF tags
 	tModelPixelScale     = 33550
@@ -217,6 +234,15 @@ const (
 	cDeflate    = 8 // zlib compression.
 	cPackBits   = 32773
 	cDeflateOld = 32946 // Superseded by cDeflate.
+	cLERC       = 34887 // Limited Error Raster Compression, as written by GDAL.
+	cZSTD       = 50000 // Zstandard.
+)
+
+// Compression applied on top of LERC, the second of the LercParameters.
+const (
+	lercAddNone    = 0
+	lercAddDeflate = 1
+	lercAddZSTD    = 2
 )
 
 // Photometric interpretation values (see p. 37 of the spec).
@@ -233,8 +259,9 @@ const (
 
 // Values for the tPredictor tag (page 64-65 of the spec).
 const (
-	prNone       = 1
-	prHorizontal = 2
+	prNone          = 1
+	prHorizontal    = 2
+	prFloatingPoint = 3
 )
 
 // Values for the tResolutionUnit tag (page 18).
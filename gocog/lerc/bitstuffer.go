@@ -0,0 +1,146 @@
+package lerc
+
+import "encoding/binary"
+
+// unstuff decodes a block of bit-stuffed unsigned integers, as Esri's
+// BitStuffer2 writes them, from the start of src into dst, which it resizes.
+// It returns the number of bytes read, or an error if the block is malformed
+// or holds more than max integers.
+//
+// A block starts with a byte whose bits 6 and 7 tell how many bytes the count
+// of integers takes, bit 5 whether the integers index a table of values, and
+// bits 0 to 4 how many bits each integer or table value takes.
+func unstuff(dst []uint32, src []byte, max, version int) ([]uint32, int, error) {
+	if len(src) < 1 {
+		return nil, 0, errShort
+	}
+	head := src[0]
+	off := 1
+	nb := 4
+	switch head >> 6 {
+	case 1:
+		nb = 2
+	case 2:
+		nb = 1
+	case 3:
+		return nil, 0, errFormat("bit stuffing header")
+	}
+	if len(src) < off+nb {
+		return nil, 0, errShort
+	}
+	var n int
+	switch nb {
+	case 1:
+		n = int(src[off])
+	case 2:
+		n = int(binary.LittleEndian.Uint16(src[off:]))
+	case 4:
+		n = int(binary.LittleEndian.Uint32(src[off:]))
+	}
+	off += nb
+	if n < 0 || n > max {
+		return nil, 0, errFormat("bit stuffed count")
+	}
+	lut := head&(1<<5) != 0
+	bits := int(head & 31)
+
+	if !lut {
+		if bits == 0 {
+			dst = grow(dst, n)
+			for i := range dst {
+				dst[i] = 0
+			}
+			return dst, off, nil
+		}
+		dst, m, err := unpack(dst, src[off:], n, bits, version)
+		return dst, off + m, err
+	}
+
+	// The table leaves out its first value, which is always 0.
+	if bits == 0 || len(src) < off+1 {
+		return nil, 0, errFormat("bit stuffing table")
+	}
+	nLut := int(src[off]) - 1
+	off++
+	table, m, err := unpack(nil, src[off:], nLut, bits, version)
+	if err != nil {
+		return nil, 0, err
+	}
+	off += m
+	indexBits := 0
+	for nLut>>indexBits != 0 {
+		indexBits++
+	}
+	if indexBits == 0 {
+		return nil, 0, errFormat("bit stuffing table")
+	}
+	dst, m, err = unpack(dst, src[off:], n, indexBits, version)
+	if err != nil {
+		return nil, 0, err
+	}
+	off += m
+	for i, v := range dst {
+		switch {
+		case v == 0:
+		case int(v) <= len(table):
+			dst[i] = table[v-1]
+		default:
+			return nil, 0, errFormat("bit stuffing table index")
+		}
+	}
+	return dst, off, nil
+}
+
+// unpack reads n integers of the given number of bits from src into dst,
+// which it resizes, and returns the number of bytes read. The integers fill
+// 32-bit little-endian words, starting from the least significant bits since
+// version 3 and from the most significant bits before. Bytes of the last word
+// that hold none of the integers are left out.
+func unpack(dst []uint32, src []byte, n, bits, version int) ([]uint32, int, error) {
+	words := (n*bits + 31) / 32
+	tail := 0
+	if r := (n * bits) & 31; r != 0 {
+		tail = 4 - (r+7)/8
+	}
+	size := words*4 - tail
+	if len(src) < size {
+		return nil, 0, errShort
+	}
+	word := func(i int) uint32 {
+		if i < words-1 {
+			return binary.LittleEndian.Uint32(src[4*i:])
+		}
+		if i > words-1 {
+			return 0
+		}
+		var w [4]byte
+		copy(w[:], src[4*i:size])
+		v := binary.LittleEndian.Uint32(w[:])
+		if version < 3 {
+			// The bytes that are present are the most significant ones.
+			v <<= 8 * uint(tail)
+		}
+		return v
+	}
+
+	dst = grow(dst, n)
+	for i := range dst {
+		pos := i * bits
+		w, b := pos/32, uint(pos%32)
+		if version >= 3 {
+			v := uint64(word(w)) | uint64(word(w+1))<<32
+			dst[i] = uint32(v>>b) & (1<<bits - 1)
+		} else {
+			v := uint64(word(w))<<32 | uint64(word(w+1))
+			dst[i] = uint32(v << b >> (64 - uint(bits)))
+		}
+	}
+	return dst, size, nil
+}
+
+func grow(s []uint32, n int) []uint32 {
+	if cap(s) < n {
+		return make([]uint32, n)
+	}
+	return s[:n]
+}
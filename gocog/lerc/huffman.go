@@ -0,0 +1,128 @@
+package lerc
+
+import "encoding/binary"
+
+// bitReader reads bits from a sequence of 32-bit little-endian words, most
+// significant bit first.
+type bitReader struct {
+	src []byte
+	pos int // In bits.
+}
+
+func (r *bitReader) bit() (uint32, error) {
+	i := r.pos / 32
+	// Encoders may leave out the bytes of the last word they do not need.
+	if 4*i >= len(r.src) {
+		return 0, errShort
+	}
+	var w [4]byte
+	copy(w[:], r.src[4*i:])
+	b := binary.LittleEndian.Uint32(w[:]) >> (31 - uint(r.pos%32)) & 1
+	r.pos++
+	return b, nil
+}
+
+// bytesRead returns the number of bytes of the words read so far.
+func (r *bitReader) bytesRead() int {
+	return (r.pos + 31) / 32 * 4
+}
+
+// huffman decodes the Huffman codes Lerc2 may store 8-bit images with.
+type huffman struct {
+	// tree holds the children reached by bits 0 and 1 of each inner node,
+	// the root first. A child is the index of another inner node, -1-v for
+	// a leaf of value v, or 0 for none.
+	tree [][2]int32
+}
+
+// readTable reads the code table at the start of src and returns the number
+// of bytes it takes.
+//
+// The table starts with 4 32-bit integers: its version, the number of
+// values, and the range of values that have a code, which may wrap around.
+// Bit-stuffed code lengths for that range follow, and then the codes.
+func (h *huffman) readTable(src []byte, version int) (int, error) {
+	if len(src) < 16 {
+		return 0, errShort
+	}
+	le := binary.LittleEndian
+	v := int32(le.Uint32(src))
+	size := int(int32(le.Uint32(src[4:])))
+	i0 := int(int32(le.Uint32(src[8:])))
+	i1 := int(int32(le.Uint32(src[12:])))
+	off := 16
+	if v < 2 || i0 < 0 || i0 >= i1 || size <= 0 || size > 1<<15 {
+		return 0, errFormat("Huffman code table")
+	}
+	wrap := func(i int) int {
+		if i >= size {
+			return i - size
+		}
+		return i
+	}
+	if wrap(i0) >= size || wrap(i1-1) >= size {
+		return 0, errFormat("Huffman code table")
+	}
+
+	lens, n, err := unstuff(nil, src[off:], i1-i0, version)
+	if err != nil {
+		return 0, err
+	}
+	off += n
+	if len(lens) != i1-i0 {
+		return 0, errFormat("Huffman code lengths")
+	}
+
+	h.tree = append(h.tree[:0], [2]int32{})
+	r := bitReader{src: src[off:]}
+	for i, l := range lens {
+		if l == 0 {
+			continue
+		}
+		if l > 32 {
+			return 0, errFormat("Huffman code length")
+		}
+		node := 0
+		for k := uint32(0); k < l; k++ {
+			b, err := r.bit()
+			if err != nil {
+				return 0, err
+			}
+			c := h.tree[node][b]
+			switch {
+			case k == l-1:
+				if c != 0 {
+					return 0, errFormat("Huffman codes")
+				}
+				h.tree[node][b] = int32(-1 - wrap(i0+i))
+			case c < 0:
+				return 0, errFormat("Huffman codes")
+			case c == 0:
+				h.tree = append(h.tree, [2]int32{})
+				c = int32(len(h.tree) - 1)
+				h.tree[node][b] = c
+			}
+			node = int(c)
+		}
+	}
+	return off + r.bytesRead(), nil
+}
+
+// decode reads the next code from r and returns its value.
+func (h *huffman) decode(r *bitReader) (int, error) {
+	node := 0
+	for {
+		b, err := r.bit()
+		if err != nil {
+			return 0, err
+		}
+		c := h.tree[node][b]
+		switch {
+		case c < 0:
+			return int(-1 - c), nil
+		case c == 0:
+			return 0, errFormat("Huffman code")
+		}
+		node = int(c)
+	}
+}
@@ -0,0 +1,800 @@
+// Package lerc implements a decoder for Lerc2, Esri's Limited Error Raster
+// Compression, versions 2 to 6. Lossless floating point images that version 6
+// stores with its byte-splitting codec are not supported.
+//
+// TIFF files store tiles compressed with LERC since GDAL 2.4, as compression
+// value 34887, usually for elevation data. Each tile holds a Lerc2 blob, which
+// may further be compressed with Deflate or Zstandard.
+//
+// A Lerc2 blob holds an image of one or more values per pixel, all of the
+// same type, together with a mask of the pixels that are valid. It is split
+// into micro blocks, whose values are stored as offsets from the smallest one
+// in the block, quantized to within MaxZError and packed into as few bits as
+// they need. Since version 2, 8-bit images may instead be Huffman coded.
+package lerc
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+var errShort = errors.New("lerc: unexpected end of data")
+
+type errFormat string
+
+func (e errFormat) Error() string { return "lerc: invalid " + string(e) }
+
+// DataType is the type of the values of a Lerc2 blob.
+type DataType int
+
+const (
+	Char DataType = iota
+	Byte
+	Short
+	UShort
+	Int
+	UInt
+	Float
+	Double
+)
+
+// Size returns the size of a value in bytes.
+func (t DataType) Size() int {
+	switch t {
+	case Char, Byte:
+		return 1
+	case Short, UShort:
+		return 2
+	case Int, UInt, Float:
+		return 4
+	case Double:
+		return 8
+	}
+	return 0
+}
+
+// Info describes a Lerc2 blob.
+type Info struct {
+	Version        int
+	Width, Height  int
+	Depth          int // Values per pixel.
+	ValidPixels    int
+	MicroBlockSize int
+	BlobSize       int // Length of the blob in bytes.
+	DataType       DataType
+	MaxZError      float64
+	ZMin, ZMax     float64
+
+	// Since version 6, NoData values of images of several values per pixel
+	// may be encoded as NoData and decoded as NoDataOrig.
+	PassNoData         bool
+	IsInt              bool // Floating point values are integers.
+	NoData, NoDataOrig float64
+}
+
+const (
+	magic      = "Lerc2 "
+	maxVersion = 6
+)
+
+// DecodeInfo reads the header of the Lerc2 blob at the start of src.
+func DecodeInfo(src []byte) (Info, error) {
+	info, _, err := readHeader(src)
+	return info, err
+}
+
+// readHeader reads the header of the Lerc2 blob at the start of src and
+// returns the number of bytes it takes.
+func readHeader(src []byte) (Info, int, error) {
+	var info Info
+	if len(src) < len(magic)+4 {
+		return info, 0, errShort
+	}
+	if string(src[:len(magic)]) != magic {
+		if string(src[:9]) == "CntZImage" {
+			return info, 0, errors.New("lerc: Lerc1 blobs are not supported")
+		}
+		return info, 0, errFormat("header")
+	}
+	le := binary.LittleEndian
+	off := len(magic)
+	info.Version = int(int32(le.Uint32(src[off:])))
+	off += 4
+	if info.Version < 2 || info.Version > maxVersion {
+		return info, 0, fmt.Errorf("lerc: unsupported version %d", info.Version)
+	}
+
+	var checksum uint32
+	nInts, nDbls := 6, 3
+	if info.Version >= 3 {
+		nInts++ // The checksum.
+	}
+	if info.Version >= 4 {
+		nInts++
+	}
+	if info.Version >= 6 {
+		nInts++
+		nDbls += 2
+	}
+	n := off + 4*nInts + 8*nDbls
+	if info.Version >= 6 {
+		n += 4
+	}
+	if len(src) < n {
+		return info, 0, errShort
+	}
+	next := func() int {
+		v := int(int32(le.Uint32(src[off:])))
+		off += 4
+		return v
+	}
+	if info.Version >= 3 {
+		checksum = uint32(next())
+	}
+	info.Height = next()
+	info.Width = next()
+	info.Depth = 1
+	if info.Version >= 4 {
+		info.Depth = next()
+	}
+	info.ValidPixels = next()
+	info.MicroBlockSize = next()
+	info.BlobSize = next()
+	info.DataType = DataType(next())
+	if info.Version >= 6 {
+		next() // The number of blobs that follow.
+		info.PassNoData = src[off] != 0
+		info.IsInt = src[off+1] != 0
+		off += 4
+	}
+	nextDbl := func() float64 {
+		v := math.Float64frombits(le.Uint64(src[off:]))
+		off += 8
+		return v
+	}
+	info.MaxZError = nextDbl()
+	info.ZMin = nextDbl()
+	info.ZMax = nextDbl()
+	if info.Version >= 6 {
+		info.NoData = nextDbl()
+		info.NoDataOrig = nextDbl()
+	}
+
+	switch {
+	case info.Width <= 0 || info.Height <= 0 || info.Depth <= 0:
+		return info, 0, errFormat("dimensions")
+	case info.ValidPixels < 0 || info.ValidPixels > info.Width*info.Height:
+		return info, 0, errFormat("number of valid pixels")
+	case info.MicroBlockSize <= 0:
+		return info, 0, errFormat("micro block size")
+	case info.DataType < Char || info.DataType > Double:
+		return info, 0, errFormat("data type")
+	case info.BlobSize < off || info.BlobSize > len(src):
+		return info, 0, errShort
+	}
+
+	// The checksum covers everything after itself.
+	if info.Version >= 3 && fletcher32(src[14:info.BlobSize]) != checksum {
+		return info, 0, errFormat("checksum")
+	}
+	return info, off, nil
+}
+
+// fletcher32 returns the Fletcher-32 checksum of p, its bytes taken as
+// big-endian 16-bit words.
+func fletcher32(p []byte) uint32 {
+	sum1, sum2 := uint32(0xffff), uint32(0xffff)
+	for len(p) >= 2 {
+		// Reduce the sums often enough for them not to overflow.
+		n := len(p) / 2
+		if n > 359 {
+			n = 359
+		}
+		for ; n > 0; n-- {
+			sum1 += uint32(p[0])<<8 | uint32(p[1])
+			sum2 += sum1
+			p = p[2:]
+		}
+		sum1 = sum1&0xffff + sum1>>16
+		sum2 = sum2&0xffff + sum2>>16
+	}
+	if len(p) == 1 {
+		sum1 += uint32(p[0]) << 8
+		sum2 += sum1
+	}
+	sum1 = sum1&0xffff + sum1>>16
+	sum2 = sum2&0xffff + sum2>>16
+	return sum2<<16 | sum1
+}
+
+// Decode decodes the Lerc2 blob at the start of src into dst, which holds
+// the values of Width×Height pixels row by row, each pixel being stride
+// values of the blob's DataType in byte order bo. The Depth values of each
+// pixel of the blob go to the values of the pixel from first on, so that the
+// blobs of several bands can be decoded into one pixel-interleaved image.
+// Values of invalid pixels are set to NaN for floating point data types and
+// to zero otherwise.
+func Decode(dst []byte, stride, first int, bo binary.ByteOrder, src []byte) (Info, error) {
+	info, off, err := readHeader(src)
+	if err != nil {
+		return info, err
+	}
+	if first < 0 || first+info.Depth > stride {
+		return info, fmt.Errorf("lerc: %d values per pixel do not fit in %d from %d", info.Depth, stride, first)
+	}
+	if len(dst) < info.Width*info.Height*stride*info.DataType.Size() {
+		return info, fmt.Errorf("lerc: buffer too short for %dx%d pixels", info.Width, info.Height)
+	}
+	d := decoder{
+		info: info,
+		src:  src[:info.BlobSize],
+		off:  off,
+		v:    values{b: dst, bo: bo, dt: info.DataType, stride: stride, first: first},
+	}
+	return info, d.decode()
+}
+
+// DecodeMask decodes the mask of valid pixels of the Lerc2 blob at the start
+// of src into dst, which holds Width×Height pixels row by row, each pixel
+// being stride bytes. Byte first of each pixel is set to 0xff if the pixel is
+// valid and to zero otherwise. libtiff stores the alpha band of 8-bit images
+// this way rather than as values of the blob.
+func DecodeMask(dst []byte, stride, first int, src []byte) (Info, error) {
+	info, off, err := readHeader(src)
+	if err != nil {
+		return info, err
+	}
+	if first < 0 || first >= stride {
+		return info, fmt.Errorf("lerc: mask does not fit in %d values from %d", stride, first)
+	}
+	n := info.Width * info.Height
+	if len(dst) < n*stride {
+		return info, fmt.Errorf("lerc: buffer too short for %dx%d pixels", info.Width, info.Height)
+	}
+	d := decoder{info: info, src: src[:info.BlobSize], off: off}
+	if err := d.readMask(); err != nil {
+		return info, err
+	}
+	for k := 0; k < n; k++ {
+		dst[k*stride+first] = 0
+		if d.valid(k) {
+			dst[k*stride+first] = 0xff
+		}
+	}
+	return info, nil
+}
+
+// decoder holds the state of the decoding of a blob.
+type decoder struct {
+	info Info
+	src  []byte
+	off  int    // Of the next byte to read from src.
+	mask []byte // One bit per pixel, most significant first; nil if all are valid.
+	v    values
+
+	zMin, zMax []float64 // For each depth, since version 4.
+	buf        []uint32
+}
+
+func (d *decoder) decode() error {
+	if err := d.readMask(); err != nil {
+		return err
+	}
+	info := d.info
+	n := info.Width * info.Height
+
+	invalid := 0.0
+	if info.DataType == Float || info.DataType == Double {
+		invalid = math.NaN()
+	}
+	for k := 0; k < n; k++ {
+		if !d.valid(k) {
+			for m := 0; m < info.Depth; m++ {
+				d.v.set(k, m, invalid)
+			}
+		}
+	}
+	if info.ValidPixels == 0 {
+		return nil
+	}
+
+	d.zMin = make([]float64, info.Depth)
+	d.zMax = make([]float64, info.Depth)
+	for m := range d.zMin {
+		d.zMin[m], d.zMax[m] = info.ZMin, info.ZMax
+	}
+	if info.ZMin == info.ZMax {
+		return d.fillConst()
+	}
+	if info.Version >= 4 {
+		if err := d.readRanges(); err != nil {
+			return err
+		}
+		same := true
+		for m := range d.zMin {
+			same = same && d.zMin[m] == d.zMax[m]
+		}
+		if same {
+			return d.fillConst()
+		}
+	}
+
+	oneSweep, err := d.byte()
+	if err != nil {
+		return err
+	}
+	switch {
+	case oneSweep != 0:
+		err = d.readOneSweep()
+	case info.DataType <= Byte && info.MaxZError == 0.5:
+		var mode byte
+		mode, err = d.byte()
+		switch {
+		case err != nil:
+		case mode > 2 || (info.Version < 4 && mode > 1):
+			err = errFormat("image encoding mode")
+		case mode > 0:
+			err = d.readHuffman(mode == 1)
+		default:
+			err = d.readTiles()
+		}
+	case info.Version >= 6 && info.DataType >= Float && info.MaxZError == 0:
+		var mode byte
+		mode, err = d.byte()
+		switch {
+		case err != nil:
+		case mode != 0:
+			// Since version 6, lossless floating point images may be
+			// byte-split and Huffman coded instead.
+			err = fmt.Errorf("lerc: lossless floating point encoding %d is not supported", mode)
+		default:
+			err = d.readTiles()
+		}
+	default:
+		err = d.readTiles()
+	}
+	if err != nil {
+		return err
+	}
+
+	if info.Version >= 6 && info.PassNoData && info.NoData != info.NoDataOrig {
+		for k := 0; k < n; k++ {
+			if !d.valid(k) {
+				continue
+			}
+			for m := 0; m < info.Depth; m++ {
+				if d.v.get(k, m) == info.NoData {
+					d.v.set(k, m, info.NoDataOrig)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (d *decoder) byte() (byte, error) {
+	if d.off >= len(d.src) {
+		return 0, errShort
+	}
+	b := d.src[d.off]
+	d.off++
+	return b, nil
+}
+
+// valid tells whether pixel k is valid.
+func (d *decoder) valid(k int) bool {
+	return d.mask == nil || d.mask[k>>3]&(0x80>>(k&7)) != 0
+}
+
+// readMask reads the mask of valid pixels, which is run-length encoded unless
+// either all or no pixels are valid. Runs start with a signed 16-bit count:
+// as many bytes follow if it is positive, a byte to repeat -count times if
+// it is negative. A count of -32768 ends the mask.
+func (d *decoder) readMask() error {
+	if d.off+4 > len(d.src) {
+		return errShort
+	}
+	size := int(int32(binary.LittleEndian.Uint32(d.src[d.off:])))
+	d.off += 4
+	n := d.info.Width * d.info.Height
+	switch {
+	case d.info.ValidPixels == n:
+		d.mask = nil
+	case d.info.ValidPixels == 0:
+		d.mask = make([]byte, (n+7)/8)
+	case size <= 0:
+		return errFormat("mask")
+	default:
+		if d.off+size > len(d.src) {
+			return errShort
+		}
+		src := d.src[d.off : d.off+size]
+		d.mask = make([]byte, 0, (n+7)/8)
+		for {
+			if len(src) < 2 {
+				return errShort
+			}
+			cnt := int(int16(binary.LittleEndian.Uint16(src)))
+			src = src[2:]
+			if cnt == -32768 {
+				break
+			}
+			if cnt > 0 {
+				if len(src) < cnt || len(d.mask)+cnt > cap(d.mask) {
+					return errFormat("mask")
+				}
+				d.mask = append(d.mask, src[:cnt]...)
+				src = src[cnt:]
+				continue
+			}
+			if len(src) < 1 || len(d.mask)-cnt > cap(d.mask) {
+				return errFormat("mask")
+			}
+			for i := 0; i < -cnt; i++ {
+				d.mask = append(d.mask, src[0])
+			}
+			src = src[1:]
+		}
+		if len(d.mask) != cap(d.mask) {
+			return errFormat("mask")
+		}
+	}
+	if size > 0 {
+		d.off += size
+	}
+	return nil
+}
+
+// readRanges reads the smallest and largest values of each depth.
+func (d *decoder) readRanges() error {
+	size := d.info.DataType.Size()
+	n := d.info.Depth * size
+	if d.off+2*n > len(d.src) {
+		return errShort
+	}
+	for m := range d.zMin {
+		d.zMin[m] = d.read(d.info.DataType, d.src[d.off+m*size:])
+		d.zMax[m] = d.read(d.info.DataType, d.src[d.off+n+m*size:])
+	}
+	d.off += 2 * n
+	return nil
+}
+
+// fillConst sets the values of each depth of all valid pixels to the
+// smallest value of that depth.
+func (d *decoder) fillConst() error {
+	for k, n := 0, d.info.Width*d.info.Height; k < n; k++ {
+		if d.valid(k) {
+			for m, z := range d.zMin {
+				d.v.set(k, m, z)
+			}
+		}
+	}
+	return nil
+}
+
+// readOneSweep reads the values of all valid pixels, stored one after the
+// other without compression.
+func (d *decoder) readOneSweep() error {
+	size := d.info.DataType.Size()
+	for k, n := 0, d.info.Width*d.info.Height; k < n; k++ {
+		if !d.valid(k) {
+			continue
+		}
+		if d.off+d.info.Depth*size > len(d.src) {
+			return errShort
+		}
+		for m := 0; m < d.info.Depth; m++ {
+			d.v.set(k, m, d.read(d.info.DataType, d.src[d.off:]))
+			d.off += size
+		}
+	}
+	return nil
+}
+
+// readHuffman reads Huffman coded 8-bit values. If delta is set, each code
+// gives the difference to the value to the left, or above if that pixel is
+// invalid, for each depth on its own.
+func (d *decoder) readHuffman(delta bool) error {
+	var h huffman
+	n, err := h.readTable(d.src[d.off:], d.info.Version)
+	if err != nil {
+		return err
+	}
+	d.off += n
+
+	offset := 0
+	if d.info.DataType == Char {
+		offset = 128
+	}
+	r := bitReader{src: d.src[d.off:]}
+	w, ht, depth := d.info.Width, d.info.Height, d.info.Depth
+
+	if !delta {
+		for k := 0; k < w*ht; k++ {
+			if !d.valid(k) {
+				continue
+			}
+			for m := 0; m < depth; m++ {
+				v, err := h.decode(&r)
+				if err != nil {
+					return err
+				}
+				d.v.set(k, m, float64(v-offset))
+			}
+		}
+		return nil
+	}
+
+	for m := 0; m < depth; m++ {
+		prev := 0.0
+		for i, k := 0, 0; i < ht; i++ {
+			for j := 0; j < w; j, k = j+1, k+1 {
+				if !d.valid(k) {
+					continue
+				}
+				v, err := h.decode(&r)
+				if err != nil {
+					return err
+				}
+				z := float64(v - offset)
+				if (j == 0 || !d.valid(k-1)) && i > 0 && d.valid(k-w) {
+					z += d.v.get(k-w, m)
+				} else {
+					z += prev
+				}
+				// Values wrap around like the 8-bit integers they are.
+				d.v.set(k, m, z)
+				prev = d.v.get(k, m)
+			}
+		}
+	}
+	return nil
+}
+
+// readTiles reads the micro blocks of the image, row by row, each holding
+// all depths one after the other.
+func (d *decoder) readTiles() error {
+	mb := d.info.MicroBlockSize
+	w, h := d.info.Width, d.info.Height
+	for i0 := 0; i0 < h; i0 += mb {
+		i1 := i0 + mb
+		if i1 > h {
+			i1 = h
+		}
+		for j0 := 0; j0 < w; j0 += mb {
+			j1 := j0 + mb
+			if j1 > w {
+				j1 = w
+			}
+			for m := 0; m < d.info.Depth; m++ {
+				if err := d.readTile(i0, i1, j0, j1, m); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// readTile reads the values of depth m of the micro block of rows i0 to i1
+// and columns j0 to j1.
+//
+// A micro block starts with a byte whose bits 0 and 1 tell how its values are
+// stored: 0 uncompressed, 1 bit-stuffed, 2 all zero and 3 all the same.
+// Bits 2 to 5 repeat bits 3 to 6 of j0 as a check, bits 3 to 5 repeat bits 4
+// to 6 of j0 since version 5, and
+// bits 6 and 7 tell which smaller type the offset of the block is stored as.
+// Since version 5, bit 2 tells that the values of the block are differences
+// to those of the previous depth.
+func (d *decoder) readTile(i0, i1, j0, j1, m int) error {
+	flag, err := d.byte()
+	if err != nil {
+		return err
+	}
+	info := d.info
+	diff := false
+	if info.Version >= 5 {
+		if int(flag>>3&7) != j0>>4&7 {
+			return errFormat("micro block")
+		}
+		diff = flag&4 != 0
+	} else if int(flag>>2&15) != j0>>3&15 {
+		return errFormat("micro block")
+	}
+	if diff && m == 0 {
+		return errFormat("micro block")
+	}
+	typeCode := int(flag >> 6)
+	w := info.Width
+
+	// each calls f with the index of each valid pixel of the block.
+	each := func(f func(k int) error) error {
+		for i := i0; i < i1; i++ {
+			for k := i*w + j0; k < i*w+j1; k++ {
+				if d.valid(k) {
+					if err := f(k); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		return nil
+	}
+	// put sets value m of pixel k to z, or to z plus value m-1 if the block
+	// is difference coded.
+	put := func(k int, z float64) {
+		if diff {
+			z += d.v.get(k, m-1)
+		}
+		d.v.set(k, m, z)
+	}
+
+	switch flag & 3 {
+	case 2:
+		return each(func(k int) error {
+			put(k, 0)
+			return nil
+		})
+	case 0:
+		if diff {
+			return errFormat("micro block")
+		}
+		size := info.DataType.Size()
+		return each(func(k int) error {
+			if d.off+size > len(d.src) {
+				return errShort
+			}
+			d.v.set(k, m, d.read(info.DataType, d.src[d.off:]))
+			d.off += size
+			return nil
+		})
+	}
+
+	dt := info.DataType
+	if diff && dt < Float {
+		dt = Int
+	}
+	dt = offsetType(dt, typeCode)
+	if d.off+dt.Size() > len(d.src) {
+		return errShort
+	}
+	offset := d.read(dt, d.src[d.off:])
+	d.off += dt.Size()
+	zMax := info.ZMax
+	if info.Version >= 4 && info.Depth > 1 {
+		zMax = d.zMax[m]
+	}
+
+	if flag&3 == 3 {
+		return each(func(k int) error {
+			put(k, offset)
+			return nil
+		})
+	}
+
+	max := (i1 - i0) * (j1 - j0)
+	var n int
+	d.buf, n, err = unstuff(d.buf, d.src[d.off:], max, info.Version)
+	if err != nil {
+		return err
+	}
+	d.off += n
+	// The values of the valid pixels follow each other.
+	scale := 2 * info.MaxZError
+	i := 0
+	return each(func(k int) error {
+		if i >= len(d.buf) {
+			return errFormat("micro block")
+		}
+		z := offset + float64(d.buf[i])*scale
+		i++
+		if diff {
+			z += d.v.get(k, m-1)
+		}
+		if z > zMax {
+			z = zMax
+		}
+		d.v.set(k, m, z)
+		return nil
+	})
+}
+
+// offsetType returns the type the offset of a micro block of values of type
+// t is stored as, given bits 6 and 7 of the block's first byte.
+func offsetType(t DataType, code int) DataType {
+	switch t {
+	case Short, Int:
+		return t - DataType(code)
+	case UShort, UInt:
+		return t - 2*DataType(code)
+	case Float:
+		switch code {
+		case 1:
+			return Short
+		case 2:
+			return Byte
+		}
+	case Double:
+		if code != 0 {
+			return t - 2*DataType(code) + 1
+		}
+	}
+	return t
+}
+
+// read returns the little-endian value of type t at the start of p.
+func (d *decoder) read(t DataType, p []byte) float64 {
+	le := binary.LittleEndian
+	switch t {
+	case Char:
+		return float64(int8(p[0]))
+	case Byte:
+		return float64(p[0])
+	case Short:
+		return float64(int16(le.Uint16(p)))
+	case UShort:
+		return float64(le.Uint16(p))
+	case Int:
+		return float64(int32(le.Uint32(p)))
+	case UInt:
+		return float64(le.Uint32(p))
+	case Float:
+		return float64(math.Float32frombits(le.Uint32(p)))
+	}
+	return math.Float64frombits(le.Uint64(p))
+}
+
+// values gives access to the decoded values.
+type values struct {
+	b             []byte
+	bo            binary.ByteOrder
+	dt            DataType
+	stride, first int
+}
+
+// index returns the index in v.b of value m of pixel k.
+func (v values) index(k, m int) int {
+	return (k*v.stride + v.first + m) * v.dt.Size()
+}
+
+func (v values) get(k, m int) float64 {
+	p := v.b[v.index(k, m):]
+	switch v.dt {
+	case Char:
+		return float64(int8(p[0]))
+	case Byte:
+		return float64(p[0])
+	case Short:
+		return float64(int16(v.bo.Uint16(p)))
+	case UShort:
+		return float64(v.bo.Uint16(p))
+	case Int:
+		return float64(int32(v.bo.Uint32(p)))
+	case UInt:
+		return float64(v.bo.Uint32(p))
+	case Float:
+		return float64(math.Float32frombits(v.bo.Uint32(p)))
+	}
+	return math.Float64frombits(v.bo.Uint64(p))
+}
+
+// set sets value m of pixel k to z. Integers are truncated and wrap around
+// if out of range.
+func (v values) set(k, m int, z float64) {
+	p := v.b[v.index(k, m):]
+	switch v.dt {
+	case Char, Byte:
+		p[0] = byte(int64(z))
+	case Short, UShort:
+		v.bo.PutUint16(p, uint16(int64(z)))
+	case Int, UInt:
+		v.bo.PutUint32(p, uint32(int64(z)))
+	case Float:
+		v.bo.PutUint32(p, math.Float32bits(float32(z)))
+	case Double:
+		v.bo.PutUint64(p, math.Float64bits(z))
+	}
+}
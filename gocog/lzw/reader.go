@@ -8,7 +8,7 @@
 //
 // In particular, it implements LZW as used by the TIFF file format, including
 // an "off by one" algorithmic difference when compared to standard LZW.
-package lzw // import "github.com/terrascope/gocog/lzw"
+package lzw
 
 /*
 This file was branched from src/pkg/compress/lzw/reader.go in the
@@ -240,6 +240,21 @@ func (d *decoder) Close() error {
 // used during compression.
 func NewReader(r io.Reader, order Order, litWidth int) io.ReadCloser {
 	d := new(decoder)
+	d.Reset(r, order, litWidth)
+	return d
+}
+
+// Resetter resets an io.ReadCloser returned by NewReader to read from r, as
+// if it had been returned by NewReader(r, order, litWidth). This lets a
+// decompressor, and its tables of several kilobytes, be reused.
+type Resetter interface {
+	Reset(r io.Reader, order Order, litWidth int)
+}
+
+func (d *decoder) Reset(r io.Reader, order Order, litWidth int) {
+	d.err = nil
+	d.bits, d.nBits = 0, 0
+	d.o, d.toRead = 0, nil
 	switch order {
 	case LSB:
 		d.read = (*decoder).readLSB
@@ -247,11 +262,11 @@ func NewReader(r io.Reader, order Order, litWidth int) io.ReadCloser {
 		d.read = (*decoder).readMSB
 	default:
 		d.err = errors.New("lzw: unknown order")
-		return d
+		return
 	}
 	if litWidth < 2 || 8 < litWidth {
 		d.err = fmt.Errorf("lzw: litWidth %d out of range", litWidth)
-		return d
+		return
 	}
 	if br, ok := r.(io.ByteReader); ok {
 		d.r = br
@@ -264,6 +279,4 @@ func NewReader(r io.Reader, order Order, litWidth int) io.ReadCloser {
 	d.eof, d.hi = d.clear+1, d.clear+1
 	d.overflow = uint16(1) << d.width
 	d.last = decoderInvalidCode
-
-	return d
-}
\ No newline at end of file
+}
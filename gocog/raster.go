@@ -0,0 +1,462 @@
+package gocog
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+)
+
+// DataType is the type of the samples of a Raster.
+type DataType int
+
+const (
+	UInt8 DataType = iota + 1
+	Int8
+	UInt16
+	Int16
+	Float32
+	Float64
+	UInt32
+	Int32
+	UInt64
+	Int64
+)
+
+// Size returns the size of one sample in bytes.
+func (t DataType) Size() int {
+	switch t {
+	case UInt8, Int8:
+		return 1
+	case UInt16, Int16:
+		return 2
+	case Float32, UInt32, Int32:
+		return 4
+	case Float64, UInt64, Int64:
+		return 8
+	}
+	return 0
+}
+
+func (t DataType) String() string {
+	switch t {
+	case UInt8:
+		return "UInt8"
+	case Int8:
+		return "Int8"
+	case UInt16:
+		return "UInt16"
+	case Int16:
+		return "Int16"
+	case Float32:
+		return "Float32"
+	case Float64:
+		return "Float64"
+	case UInt32:
+		return "UInt32"
+	case Int32:
+		return "Int32"
+	case UInt64:
+		return "UInt64"
+	case Int64:
+		return "Int64"
+	}
+	return fmt.Sprintf("DataType(%d)", int(t))
+}
+
+// Raster is a rectangle of pixels made of one or more bands, whose samples
+// all have the same type. The samples of a pixel follow each other band by
+// band, and each sample is stored in little-endian byte order. Samples of
+// fewer than 8 bits are stored as UInt8. Samples, BandSamples and SampleAt
+// read them as a Go type of choice.
+//
+// A Raster is also an image.Image, which shows the first band as gray or the
+// first three bands as red, green and blue, with a fourth band as alpha.
+// Floating point samples are shown in the range from 0 to 1, and pixels whose
+// first band holds no data are transparent.
+type Raster struct {
+	Rect     image.Rectangle
+	Bands    int
+	DataType DataType
+	// NoData is the value of samples that hold no data, if HasNoData is set.
+	// It may be NaN.
+	NoData    float64
+	HasNoData bool
+	Pix       []byte
+	// Stride is the distance in bytes between vertically adjacent pixels.
+	Stride int
+}
+
+// NewRaster returns a Raster of the given bounds, number of bands and data
+// type, with all samples set to zero.
+func NewRaster(r image.Rectangle, bands int, t DataType) *Raster {
+	stride := r.Dx() * bands * t.Size()
+	return &Raster{
+		Rect:     r,
+		Bands:    bands,
+		DataType: t,
+		Pix:      make([]byte, stride*r.Dy()),
+		Stride:   stride,
+	}
+}
+
+// PixOffset returns the index of the first byte of the pixel at (x, y) in
+// Pix.
+func (r *Raster) PixOffset(x, y int) int {
+	return (y-r.Rect.Min.Y)*r.Stride + (x-r.Rect.Min.X)*r.Bands*r.DataType.Size()
+}
+
+// Band returns a copy of band b of r as a single-band Raster.
+func (r *Raster) Band(b int) (*Raster, error) {
+	if b < 0 || b >= r.Bands {
+		return nil, fmt.Errorf("band %d not in raster of %d bands", b, r.Bands)
+	}
+	size := r.DataType.Size()
+	band := NewRaster(r.Rect, 1, r.DataType)
+	band.NoData, band.HasNoData = r.NoData, r.HasNoData
+	for y := r.Rect.Min.Y; y < r.Rect.Max.Y; y++ {
+		src := r.PixOffset(r.Rect.Min.X, y) + b*size
+		dst := band.PixOffset(r.Rect.Min.X, y)
+		for x := r.Rect.Min.X; x < r.Rect.Max.X; x++ {
+			copy(band.Pix[dst:dst+size], r.Pix[src:src+size])
+			src += r.Bands * size
+			dst += size
+		}
+	}
+	return band, nil
+}
+
+func (r *Raster) Bounds() image.Rectangle {
+	return r.Rect
+}
+
+// Float64At returns the sample of band b at (x, y) as a float64.
+func (r *Raster) Float64At(b, x, y int) float64 {
+	if !(image.Point{x, y}.In(r.Rect)) || b < 0 || b >= r.Bands {
+		return 0
+	}
+	i := r.PixOffset(x, y) + b*r.DataType.Size()
+	switch r.DataType {
+	case UInt8:
+		return float64(r.Pix[i])
+	case Int8:
+		return float64(int8(r.Pix[i]))
+	case UInt16:
+		return float64(binary.LittleEndian.Uint16(r.Pix[i:]))
+	case Int16:
+		return float64(int16(binary.LittleEndian.Uint16(r.Pix[i:])))
+	case Float32:
+		return float64(math.Float32frombits(binary.LittleEndian.Uint32(r.Pix[i:])))
+	case Float64:
+		return math.Float64frombits(binary.LittleEndian.Uint64(r.Pix[i:]))
+	case UInt32:
+		return float64(binary.LittleEndian.Uint32(r.Pix[i:]))
+	case Int32:
+		return float64(int32(binary.LittleEndian.Uint32(r.Pix[i:])))
+	case UInt64:
+		return float64(binary.LittleEndian.Uint64(r.Pix[i:]))
+	case Int64:
+		return float64(int64(binary.LittleEndian.Uint64(r.Pix[i:])))
+	}
+	return 0
+}
+
+// SetFloat64 sets the sample of band b at (x, y) to v, converted to the
+// DataType of r.
+func (r *Raster) SetFloat64(b, x, y int, v float64) {
+	if !(image.Point{x, y}.In(r.Rect)) || b < 0 || b >= r.Bands {
+		return
+	}
+	i := r.PixOffset(x, y) + b*r.DataType.Size()
+	switch r.DataType {
+	case UInt8:
+		r.Pix[i] = uint8(v)
+	case Int8:
+		r.Pix[i] = uint8(int8(v))
+	case UInt16:
+		binary.LittleEndian.PutUint16(r.Pix[i:], uint16(v))
+	case Int16:
+		binary.LittleEndian.PutUint16(r.Pix[i:], uint16(int16(v)))
+	case Float32:
+		binary.LittleEndian.PutUint32(r.Pix[i:], math.Float32bits(float32(v)))
+	case Float64:
+		binary.LittleEndian.PutUint64(r.Pix[i:], math.Float64bits(v))
+	case UInt32:
+		binary.LittleEndian.PutUint32(r.Pix[i:], uint32(v))
+	case Int32:
+		binary.LittleEndian.PutUint32(r.Pix[i:], uint32(int32(v)))
+	case UInt64:
+		binary.LittleEndian.PutUint64(r.Pix[i:], uint64(v))
+	case Int64:
+		binary.LittleEndian.PutUint64(r.Pix[i:], uint64(int64(v)))
+	}
+}
+
+// IsNoData tells whether v is the NoData value of r. If NoData is NaN, every
+// NaN is.
+func (r *Raster) IsNoData(v float64) bool {
+	if !r.HasNoData {
+		return false
+	}
+	if math.IsNaN(r.NoData) {
+		return math.IsNaN(v)
+	}
+	return v == r.NoData
+}
+
+// ScaledImage returns an image of the given bands of r, one shown as gray or
+// three as red, green and blue, with the samples from min to max spread over
+// the whole range of intensities. Pixels where any of the bands holds no data
+// are transparent.
+func (r *Raster) ScaledImage(min, max float64, bands ...int) (*image.NRGBA64, error) {
+	if len(bands) != 1 && len(bands) != 3 {
+		return nil, fmt.Errorf("cannot show %d bands", len(bands))
+	}
+	for _, b := range bands {
+		if b < 0 || b >= r.Bands {
+			return nil, fmt.Errorf("band %d not in raster of %d bands", b, r.Bands)
+		}
+	}
+	scale := func(v float64) uint16 {
+		v = (v - min) / (max - min)
+		switch {
+		case !(v > 0):
+			return 0
+		case v >= 1:
+			return 0xffff
+		}
+		return uint16(v * 0xffff)
+	}
+
+	img := image.NewNRGBA64(r.Rect)
+	var c [3]uint16
+	for y := r.Rect.Min.Y; y < r.Rect.Max.Y; y++ {
+		for x := r.Rect.Min.X; x < r.Rect.Max.X; x++ {
+			noData := false
+			for i, b := range bands {
+				v := r.Float64At(b, x, y)
+				noData = noData || r.IsNoData(v)
+				c[i] = scale(v)
+			}
+			if noData {
+				continue
+			}
+			if len(bands) == 1 {
+				c[1], c[2] = c[0], c[0]
+			}
+			img.SetNRGBA64(x, y, color.NRGBA64{R: c[0], G: c[1], B: c[2], A: 0xffff})
+		}
+	}
+	return img, nil
+}
+
+func (r *Raster) ColorModel() color.Model {
+	return color.NRGBA64Model
+}
+
+func (r *Raster) At(x, y int) color.Color {
+	if !(image.Point{x, y}.In(r.Rect)) || r.IsNoData(r.Float64At(0, x, y)) {
+		return color.NRGBA64{}
+	}
+	if r.Bands < 3 {
+		v := r.sample16(0, x, y)
+		return color.NRGBA64{R: v, G: v, B: v, A: 0xffff}
+	}
+	c := color.NRGBA64{
+		R: r.sample16(0, x, y),
+		G: r.sample16(1, x, y),
+		B: r.sample16(2, x, y),
+		A: 0xffff,
+	}
+	if r.Bands == 4 {
+		c.A = r.sample16(3, x, y)
+	}
+	return c
+}
+
+// sample16 returns the sample of band b at (x, y) scaled to the range of a
+// uint16, for display.
+func (r *Raster) sample16(b, x, y int) uint16 {
+	i := r.PixOffset(x, y) + b*r.DataType.Size()
+	switch r.DataType {
+	case UInt8:
+		return uint16(r.Pix[i]) * 0x101
+	case Int8:
+		return uint16(uint8(r.Pix[i])^0x80) * 0x101
+	case UInt16:
+		return binary.LittleEndian.Uint16(r.Pix[i:])
+	case Int16:
+		return binary.LittleEndian.Uint16(r.Pix[i:]) ^ 0x8000
+	case UInt32:
+		return uint16(binary.LittleEndian.Uint32(r.Pix[i:]) >> 16)
+	case Int32:
+		return uint16((binary.LittleEndian.Uint32(r.Pix[i:]) ^ 0x80000000) >> 16)
+	case UInt64:
+		return uint16(binary.LittleEndian.Uint64(r.Pix[i:]) >> 48)
+	case Int64:
+		return uint16((binary.LittleEndian.Uint64(r.Pix[i:]) ^ 0x8000000000000000) >> 48)
+	case Float32, Float64:
+		v := r.Float64At(b, x, y)
+		switch {
+		case !(v > 0):
+			// Including NaN.
+			return 0
+		case v >= 1:
+			return 0xffff
+		}
+		return uint16(v * 0xffff)
+	}
+	return 0
+}
+
+// rasterDataType returns the type of the samples of the image described by
+// cfg, which must all have the same size and format.
+func rasterDataType(cfg ImgDesc) (DataType, error) {
+	for _, bps := range cfg.BitsPerSample[1:] {
+		if bps != cfg.BitsPerSample[0] {
+			return 0, UnsupportedError(fmt.Sprintf("BitsPerSample of %v", cfg.BitsPerSample))
+		}
+	}
+	for _, sf := range cfg.SampleFormat[1:] {
+		if sf != cfg.SampleFormat[0] {
+			return 0, UnsupportedError(fmt.Sprintf("SampleFormat of %v", cfg.SampleFormat))
+		}
+	}
+	switch sampleFormat(cfg.SampleFormat[0]) {
+	case uintSample:
+		switch cfg.BitsPerSample[0] {
+		case 1, 2, 4, 8:
+			return UInt8, nil
+		case 16:
+			return UInt16, nil
+		case 32:
+			return UInt32, nil
+		case 64:
+			return UInt64, nil
+		}
+	case sintSample:
+		switch cfg.BitsPerSample[0] {
+		case 8:
+			return Int8, nil
+		case 16:
+			return Int16, nil
+		case 32:
+			return Int32, nil
+		case 64:
+			return Int64, nil
+		}
+	case ieeefpSample:
+		switch cfg.BitsPerSample[0] {
+		case 32:
+			return Float32, nil
+		case 64:
+			return Float64, nil
+		}
+	}
+	return 0, UnsupportedError(fmt.Sprintf("BitsPerSample of %v with SampleFormat %v", cfg.BitsPerSample, cfg.SampleFormat))
+}
+
+// imageModel returns the color model of the image rasterImage returns for a
+// Raster of the given type holding all bands of the image described by cfg.
+func imageModel(t DataType, cfg ImgDesc) color.Model {
+	if cfg.SamplesPerPixel == 1 {
+		switch {
+		case t == UInt8 && cfg.PhotometricInterpr == pPaletted:
+			return palette(cfg)
+		case t == UInt8 && (cfg.PhotometricInterpr == pBlackIsZero || cfg.PhotometricInterpr == pWhiteIsZero):
+			return color.GrayModel
+		case t == UInt16 && cfg.PhotometricInterpr == pWhiteIsZero:
+			return color.Gray16Model
+		}
+	}
+	if t == UInt8 {
+		switch {
+		case cfg.SamplesPerPixel == 3 && cfg.PhotometricInterpr == pRGB:
+			return color.RGBAModel
+		case cfg.SamplesPerPixel == 4 && cfg.PhotometricInterpr == pRGB:
+			if premultipliedAlpha(cfg) {
+				return color.RGBAModel
+			}
+			return color.NRGBAModel
+		}
+	}
+	return color.NRGBA64Model
+}
+
+// palette returns the colors of the ColorMap of cfg.
+func palette(cfg ImgDesc) color.Palette {
+	n := len(cfg.ColorMap) / 3
+	p := make(color.Palette, n)
+	for i := range p {
+		p[i] = color.RGBA64{R: cfg.ColorMap[i], G: cfg.ColorMap[n+i], B: cfg.ColorMap[2*n+i], A: 0xffff}
+	}
+	return p
+}
+
+// rasterImage returns r, which holds all bands of the image described by cfg,
+// as an *image.Paletted if it is paletted, as an *image.Gray if it is gray of
+// up to 8 bits, as an *image.RGBA or *image.NRGBA if it is RGB of up to 8
+// bits, with or without alpha, and as r itself otherwise, except for 16-bit
+// WhiteIsZero images, which become an *image.Gray16. Samples of fewer than 8
+// bits are scaled to the range of 8 bits, as image/tiff does, so that a 1-bit
+// sample of 1 becomes 255, and WhiteIsZero samples are inverted; both happen
+// in a copy of the samples of r.
+func rasterImage(r *Raster, cfg ImgDesc) image.Image {
+	model := imageModel(r.DataType, cfg)
+	if p, ok := model.(color.Palette); ok {
+		return &image.Paletted{Pix: r.Pix, Stride: r.Stride, Rect: r.Rect, Palette: p}
+	}
+	switch model {
+	case color.GrayModel:
+		return &image.Gray{Pix: pix8(r, cfg), Stride: r.Stride, Rect: r.Rect}
+	case color.Gray16Model:
+		img := image.NewGray16(r.Rect)
+		for i := 0; i+1 < len(r.Pix); i += 2 {
+			binary.BigEndian.PutUint16(img.Pix[i:], 0xffff-binary.LittleEndian.Uint16(r.Pix[i:]))
+		}
+		return img
+	case color.RGBAModel:
+		pix := pix8(r, cfg)
+		if r.Bands == 4 {
+			return &image.RGBA{Pix: pix, Stride: r.Stride, Rect: r.Rect}
+		}
+		img := image.NewRGBA(r.Rect)
+		for i, j := 0, 0; i < len(pix); i, j = i+3, j+4 {
+			copy(img.Pix[j:j+3], pix[i:i+3])
+			img.Pix[j+3] = 0xff
+		}
+		return img
+	case color.NRGBAModel:
+		return &image.NRGBA{Pix: pix8(r, cfg), Stride: r.Stride, Rect: r.Rect}
+	}
+	return r
+}
+
+// pix8 returns the 8-bit samples of r, which holds all bands of the image
+// described by cfg, for display: scaled to the range of 8 bits if they have
+// fewer, and inverted if the image is WhiteIsZero. The samples of r are left
+// as they are; the result is r.Pix only if they need no change.
+func pix8(r *Raster, cfg ImgDesc) []byte {
+	bps := int(cfg.BitsPerSample[0])
+	invert := cfg.PhotometricInterpr == pWhiteIsZero
+	if bps >= 8 && !invert {
+		return r.Pix
+	}
+	max := 1<<bps - 1
+	pix := make([]byte, len(r.Pix))
+	for i, v := range r.Pix {
+		if invert {
+			v = uint8(max) - v
+		}
+		pix[i] = uint8(int(v) * 0xff / max)
+	}
+	return pix
+}
+
+// premultipliedAlpha tells whether the first extra sample of the image
+// described by cfg is alpha premultiplied into the color samples, which is
+// what image.RGBA expects, rather than unassociated alpha.
+func premultipliedAlpha(cfg ImgDesc) bool {
+	return len(cfg.ExtraSamples) > 0 && cfg.ExtraSamples[0] == 1
+}
@@ -8,22 +8,18 @@
 package gocog
 
 import (
-	"compress/zlib"
 	"encoding/binary"
 	"fmt"
 	"image"
 	"image/color"
 	"io"
-	"io/ioutil"
-	"log"
 
 	"bytes"
 	"math"
 	"strconv"
+	"sync"
 
-	"github.com/terrascope/gocog/lzw"
-	"github.com/terrascope/scimage"
-	"github.com/terrascope/scimage/scicolor"
+	"gocog/gocog/lerc"
 )
 
 // A FormatError reports that the input is not a valid TIFF image.
@@ -45,14 +41,6 @@ var errNoPixels = FormatError("not enough pixel data")
 
 type Geotransform [6]float64
 
-// minInt returns the smaller of x or y.
-func minInt(a, b int) int {
-	if a <= b {
-		return a
-	}
-	return b
-}
-
 type Overview struct {
 	Size [2]uint32 `json:"size"`
 }
@@ -60,6 +48,8 @@ type Overview struct {
 // Slightly inspired on GDALInfo json output
 type GeoInfo struct {
 	Type      string       `json:"type"`
+	Bands     int          `json:"bands"`
+	NBits     int          `json:"nbits,omitempty"` // Set for samples of fewer than 8 bits.
 	Size      [2]uint32    `json:"size"`
 	GeoTrans  Geotransform `json:"geoTransform"`
 	Proj4     string       `json:"proj4"`
@@ -84,9 +74,6 @@ func (g GeoInfo) Geotransform(level int) (Geotransform, error) {
 	return Geotransform{geot[0], geot[1] * xScale, 0, geot[3], 0, geot[5] * yScale}, nil
 }
 
-// TODO: Does cog need to support stripped files?
-// TODO: stripped files are not implemented for the moment
-
 type GeoTIFF struct {
 	kEntries     []KeyEntry
 	dParams      []float64
@@ -94,6 +81,7 @@ type GeoTIFF struct {
 	Overviews    []ImgDesc
 	GeoTrans     Geotransform
 	NoData       float64
+	HasNoData    bool // Whether the file sets NoData.
 	GDALMetadata string
 }
 
@@ -127,74 +115,167 @@ type ImgDesc struct {
 	SamplesPerPixel    uint16
 	BitsPerSample      []uint16
 	SampleFormat       []uint16
-	TileOffsets        []uint32
-	TileByteCounts     []uint32
+	ExtraSamples       []uint16
+	TileOffsets        []uint64
+	TileByteCounts     []uint64
+	// PlanarConfiguration is 1 if the samples of each pixel are stored
+	// together, and 2 if each band is stored in tiles of its own. The tiles
+	// of the first band then come first in TileOffsets, followed by those of
+	// the second band and so on.
+	PlanarConfiguration uint16
+	// Stripped tells that the image is stored in strips rather than tiles.
+	// The Tile fields then describe the strips as tiles as wide as the image.
+	Stripped bool
+	// ColorMap holds the colors of a paletted image: the red values of all
+	// 1<<BitsPerSample colors, followed by their green and their blue values.
+	ColorMap []uint16
+	// LercParameters holds the version of LERC and the compression applied
+	// on top of it for LERC compressed images.
+	LercParameters []uint32
+}
+
+// tileRef locates the data of the tile in column i and row j of a level,
+// holding the samples of the given band for band-separate images.
+type tileRef struct {
+	i, j      int
+	band      int
+	offset, n int64
+}
+
+// multiReaderAt is implemented by readers that can read several
+// non-adjacent ranges in one go, such as godal's KeyMultiReader. The key is
+// always passed as an empty string.
+type multiReaderAt interface {
+	ReadAtMulti(key string, bufs [][]byte, offs []int64) ([]int, error)
 }
 
 type decoder struct {
-	buf []byte
 	ra  io.ReaderAt
 	bo  binary.ByteOrder
+	big bool // BigTIFF, with 8-byte counts and offsets.
 	gt  GeoTIFF
 }
 
 func newDecoder(r io.Reader) (decoder, error) {
-	ra := newReaderAt(r)
+	return newDecoderAt(newReaderAt(r))
+}
+
+func newDecoderAt(ra io.ReaderAt) (decoder, error) {
 	p := make([]byte, 8)
 	if _, err := ra.ReadAt(p, 0); err != nil {
-		return decoder{}, FormatError("malformed header 1")
+		return decoder{}, readError(err, "malformed header 1")
 	}
 	switch string(p[0:4]) {
 	case leHeader:
-		return decoder{nil, ra, binary.LittleEndian, GeoTIFF{}}, nil
+		return decoder{ra: ra, bo: binary.LittleEndian}, nil
 	case beHeader:
-		return decoder{nil, ra, binary.BigEndian, GeoTIFF{}}, nil
+		return decoder{ra: ra, bo: binary.BigEndian}, nil
+	case leBigHeader, beBigHeader:
+		d := decoder{ra: ra, bo: binary.LittleEndian, big: true}
+		if p[0] == 'M' {
+			d.bo = binary.BigEndian
+		}
+		// BigTIFF headers go on with the size of offsets, which is always 8,
+		// and two bytes of zeros.
+		if d.bo.Uint16(p[4:6]) != 8 || d.bo.Uint16(p[6:8]) != 0 {
+			return decoder{}, FormatError("malformed BigTIFF header")
+		}
+		return d, nil
 	}
 
 	return decoder{}, FormatError("malformed header 2")
 }
 
+// readError returns the error to report when reading from the file failed
+// with err: a FormatError with msg if the file ended too early, and err
+// otherwise, as the file may well be fine and the reader unable to get at it.
+func readError(err error, msg string) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return FormatError(msg)
+	}
+	return fmt.Errorf("tiff: %s: %w", msg, err)
+}
+
+// offset returns the offset or count stored at the start of p, which takes
+// 8 bytes in BigTIFF files and 4 bytes otherwise.
+func (d *decoder) offset(p []byte) uint64 {
+	if d.big {
+		return d.bo.Uint64(p[0:8])
+	}
+	return uint64(d.bo.Uint32(p[0:4]))
+}
+
+// offsetLen returns the length of offsets and counts in bytes.
+func (d *decoder) offsetLen() int {
+	if d.big {
+		return 8
+	}
+	return 4
+}
+
 // parseIFD decides whether the IFD entry in p is "interesting" and
 // stows away the data in the decoder. It returns the tag number of the
 // entry and an error, if any.
 func (d *decoder) parseIFD(ifdOffset int64) (int64, error) {
 
+	// The number of entries takes 2 bytes, or 8 in BigTIFF files.
 	p := make([]byte, 8)
-	if _, err := d.ra.ReadAt(p[0:2], ifdOffset); err != nil {
-		return 0, FormatError("error reading IFD")
+	entryLen, numLen := ifdLen, 2
+	if d.big {
+		entryLen, numLen = bigIfdLen, 8
+	}
+	if _, err := d.ra.ReadAt(p[0:numLen], ifdOffset); err != nil {
+		return 0, readError(err, "error reading IFD")
+	}
+	var numItems int
+	if d.big {
+		n := d.bo.Uint64(p[0:8])
+		if n > math.MaxUint16 {
+			return 0, FormatError(fmt.Sprintf("IFD with %d entries", n))
+		}
+		numItems = int(n)
+	} else {
+		numItems = int(d.bo.Uint16(p[0:2]))
 	}
-	numItems := int(d.bo.Uint16(p[0:2]))
 
-	ifd := make([]byte, ifdLen*numItems)
-	if _, err := d.ra.ReadAt(ifd, ifdOffset+2); err != nil {
-		return 0, FormatError("error reading IFD")
+	ifd := make([]byte, entryLen*numItems)
+	if _, err := d.ra.ReadAt(ifd, ifdOffset+int64(numLen)); err != nil {
+		return 0, readError(err, "error reading IFD")
 	}
 	var pixelScale []float64
 	var tiePoint []float64
 
-	imgDesc := ImgDesc{SampleFormat: []uint16{1}, Predictor: 1}
-	var nonCaptTags []uint16
-
-	for i := 0; i < len(ifd); i += ifdLen {
-		tag := d.bo.Uint16(ifd[i : i+2])
-		datatype := d.bo.Uint16(ifd[i+2 : i+4])
-		count := d.bo.Uint32(ifd[i+4 : i+8])
+	imgDesc := ImgDesc{SampleFormat: []uint16{1}, Predictor: 1, PlanarConfiguration: 1}
+	var stripOffsets, stripByteCounts []uint64
+	rowsPerStrip := uint32(math.MaxUint32)
+
+	for i := 0; i < len(ifd); i += entryLen {
+		entry := ifd[i : i+entryLen]
+		tag := d.bo.Uint16(entry[0:2])
+		datatype := d.bo.Uint16(entry[2:4])
+		n := d.offset(entry[4:])
+		if n > math.MaxUint32 {
+			return 0, FormatError(fmt.Sprintf("tag %d count: %d not recognised", tag, n))
+		}
+		count := uint32(n)
+		// The value, or the offset to it if it does not fit.
+		val := entry[4+d.offsetLen():]
 
 		switch tag {
 		case cNewSubfileType:
 			if datatype != dtLong || count != 1 {
 				return 0, FormatError(fmt.Sprintf("NewSubfileType type: %v not recognised", datatype))
 			}
-			imgDesc.NewSubfileType = d.bo.Uint32(ifd[i+8 : i+12])
+			imgDesc.NewSubfileType = d.bo.Uint32(val[0:4])
 		case cImageWidth:
 			if count != 1 {
 				return 0, FormatError(fmt.Sprintf("ImageWidth count: %d not recognised", count))
 			}
 			switch datatype {
 			case dtShort:
-				imgDesc.ImageWidth = uint32(d.bo.Uint16(ifd[i+8 : i+10]))
+				imgDesc.ImageWidth = uint32(d.bo.Uint16(val[0:2]))
 			case dtLong:
-				imgDesc.ImageWidth = d.bo.Uint32(ifd[i+8 : i+12])
+				imgDesc.ImageWidth = d.bo.Uint32(val[0:4])
 			default:
 				return 0, FormatError(fmt.Sprintf("ImageWidth type: %d not recognised", datatype))
 			}
@@ -204,9 +285,9 @@ func (d *decoder) parseIFD(ifdOffset int64) (int64, error) {
 			}
 			switch datatype {
 			case dtShort:
-				imgDesc.ImageHeight = uint32(d.bo.Uint16(ifd[i+8 : i+10]))
+				imgDesc.ImageHeight = uint32(d.bo.Uint16(val[0:2]))
 			case dtLong:
-				imgDesc.ImageHeight = d.bo.Uint32(ifd[i+8 : i+12])
+				imgDesc.ImageHeight = d.bo.Uint32(val[0:4])
 			default:
 				return 0, FormatError(fmt.Sprintf("ImageLength type: %v not recognised", datatype))
 			}
@@ -214,42 +295,68 @@ func (d *decoder) parseIFD(ifdOffset int64) (int64, error) {
 			if datatype != dtShort {
 				return 0, FormatError(fmt.Sprintf("BitsPerSample type: %v not recognised", datatype))
 			}
-			imgDesc.BitsPerSample = []uint16{d.bo.Uint16(ifd[i+8 : i+10])}
+			bps, err := d.shortValues(tag, count, val)
+			if err != nil {
+				return 0, err
+			}
+			imgDesc.BitsPerSample = bps
 		case cCompression:
 			if datatype != dtShort || count != 1 {
 				return 0, FormatError(fmt.Sprintf("Compression type: %v or count: %d not recognised", datatype, count))
 			}
-			imgDesc.Compression = d.bo.Uint16(ifd[i+8 : i+10])
+			imgDesc.Compression = d.bo.Uint16(val[0:2])
 		case cPhotometricInterpr:
 			if datatype != dtShort || count != 1 {
 				return 0, FormatError(fmt.Sprintf("PhotometricInterpretation type: %v or count: %d not recognised", datatype, count))
 			}
-			imgDesc.PhotometricInterpr = d.bo.Uint16(ifd[i+8 : i+10])
+			imgDesc.PhotometricInterpr = d.bo.Uint16(val[0:2])
 		case cSamplesPerPixel:
 			if datatype != dtShort || count != 1 {
 				return 0, FormatError(fmt.Sprintf("SamplesPerPixel type: %v or count: %d not recognised", datatype, count))
 			}
-			imgDesc.SamplesPerPixel = d.bo.Uint16(ifd[i+8 : i+10])
+			imgDesc.SamplesPerPixel = d.bo.Uint16(val[0:2])
 		case cPlanarConfiguration:
 			if datatype != dtShort {
 				return 0, FormatError(fmt.Sprintf("SampleFormat type: %v not recognised", datatype))
 			}
-			pConf := d.bo.Uint16(ifd[i+8 : i+10])
-			if pConf != 1 {
-				return 0, fmt.Errorf("planar configuration other then 'chunky' has not been implemented: %d", pConf)
+			imgDesc.PlanarConfiguration = d.bo.Uint16(val[0:2])
+			if imgDesc.PlanarConfiguration != 1 && imgDesc.PlanarConfiguration != 2 {
+				return 0, FormatError(fmt.Sprintf("PlanarConfiguration: %d not recognised", imgDesc.PlanarConfiguration))
 			}
 		case cSampleFormat:
 			if datatype != dtShort {
 				return 0, FormatError(fmt.Sprintf("SampleFormat type: %v not recognised", datatype))
 			}
-			imgDesc.SampleFormat = []uint16{d.bo.Uint16(ifd[i+8 : i+10])}
+			sf, err := d.shortValues(tag, count, val)
+			if err != nil {
+				return 0, err
+			}
+			imgDesc.SampleFormat = sf
+		case cColorMap:
+			if datatype != dtShort {
+				return 0, FormatError(fmt.Sprintf("ColorMap type: %v not recognised", datatype))
+			}
+			colorMap, err := d.shortValues(tag, count, val)
+			if err != nil {
+				return 0, err
+			}
+			imgDesc.ColorMap = colorMap
+		case cExtraSamples:
+			if datatype != dtShort {
+				return 0, FormatError(fmt.Sprintf("ExtraSamples type: %v not recognised", datatype))
+			}
+			extra, err := d.shortValues(tag, count, val)
+			if err != nil {
+				return 0, err
+			}
+			imgDesc.ExtraSamples = extra
 		case cPredictor:
 			if datatype != dtShort {
 				return 0, FormatError(fmt.Sprintf("SampleFormat type: %v not recognised", datatype))
 			}
-			imgDesc.Predictor = d.bo.Uint16(ifd[i+8 : i+10])
-			if imgDesc.Predictor != 1 && imgDesc.Predictor != 2 {
-				return 0, fmt.Errorf("predictor other then 1=None or 2=Horizontal not implemented: %v", imgDesc.Predictor)
+			imgDesc.Predictor = d.bo.Uint16(val[0:2])
+			if imgDesc.Predictor != prNone && imgDesc.Predictor != prHorizontal && imgDesc.Predictor != prFloatingPoint {
+				return 0, fmt.Errorf("predictor other then 1=None, 2=Horizontal or 3=FloatingPoint not implemented: %v", imgDesc.Predictor)
 			}
 		case cTileWidth:
 			if count != 1 {
@@ -257,9 +364,9 @@ func (d *decoder) parseIFD(ifdOffset int64) (int64, error) {
 			}
 			switch datatype {
 			case dtShort:
-				imgDesc.TileWidth = uint32(d.bo.Uint16(ifd[i+8 : i+10]))
+				imgDesc.TileWidth = uint32(d.bo.Uint16(val[0:2]))
 			case dtLong:
-				imgDesc.TileWidth = d.bo.Uint32(ifd[i+8 : i+12])
+				imgDesc.TileWidth = d.bo.Uint32(val[0:4])
 			default:
 				return 0, FormatError(fmt.Sprintf("TileWidth type: %v not recognised", datatype))
 			}
@@ -269,41 +376,56 @@ func (d *decoder) parseIFD(ifdOffset int64) (int64, error) {
 			}
 			switch datatype {
 			case dtShort:
-				imgDesc.TileHeight = uint32(d.bo.Uint16(ifd[i+8 : i+10]))
+				imgDesc.TileHeight = uint32(d.bo.Uint16(val[0:2]))
 			case dtLong:
-				imgDesc.TileHeight = d.bo.Uint32(ifd[i+8 : i+12])
+				imgDesc.TileHeight = d.bo.Uint32(val[0:4])
 			default:
 				return 0, FormatError(fmt.Sprintf("TileLength type: %v not recognised", datatype))
 			}
-		case cTileOffsets, cTileByteCounts:
-			if datatype != dtLong {
-				return 0, FormatError(fmt.Sprintf("TileOffsets or TileByteCounts type: %v not recognised", datatype))
-			}
-
-			var raw []byte
-			if datalen := int(lengths[datatype] * count); datalen > 4 {
-				// The IFD contains a pointer to the real value.
-				raw = make([]byte, datalen)
-				d.ra.ReadAt(raw, int64(d.bo.Uint32(ifd[i+8:i+12])))
-			} else {
-				raw = ifd[i+8 : i+8+datalen]
-			}
-			data := make([]uint32, count)
-			for i := uint32(0); i < count; i++ {
-				data[i] = d.bo.Uint32(raw[4*i : 4*(i+1)])
+		case cTileOffsets, cTileByteCounts, cStripOffsets, cStripByteCounts:
+			data, err := d.uintValues(tag, datatype, count, val)
+			if err != nil {
+				return 0, err
 			}
-			if tag == cTileOffsets {
+			switch tag {
+			case cTileOffsets:
 				imgDesc.TileOffsets = data
-			} else {
+			case cTileByteCounts:
 				imgDesc.TileByteCounts = data
+			case cStripOffsets:
+				stripOffsets = data
+			case cStripByteCounts:
+				stripByteCounts = data
+			}
+		case tLercParameters:
+			data, err := d.uintValues(tag, datatype, count, val)
+			if err != nil {
+				return 0, err
+			}
+			imgDesc.LercParameters = make([]uint32, len(data))
+			for i, v := range data {
+				imgDesc.LercParameters[i] = uint32(v)
+			}
+		case cRowsPerStrip:
+			if count != 1 {
+				return 0, FormatError(fmt.Sprintf("RowsPerStrip count: %d not recognised", count))
+			}
+			switch datatype {
+			case dtShort:
+				rowsPerStrip = uint32(d.bo.Uint16(val[0:2]))
+			case dtLong:
+				rowsPerStrip = d.bo.Uint32(val[0:4])
+			default:
+				return 0, FormatError(fmt.Sprintf("RowsPerStrip type: %v not recognised", datatype))
 			}
 		case GeoDoubleParamsTag:
 			if datatype != dtFloat64 {
 				return 0, FormatError(fmt.Sprintf("DoubleParamsTag type: %v not recognised", datatype))
 			}
-			// The IFD contains a pointer to the real value.
-			raw := make([]byte, int(count)*8)
-			d.ra.ReadAt(raw, int64(d.bo.Uint32(ifd[i+8:i+12])))
+			raw, err := d.values(tag, datatype, count, val)
+			if err != nil {
+				return 0, err
+			}
 
 			d.gt.dParams = make([]float64, count)
 			for i := uint32(0); i < count; i++ {
@@ -313,17 +435,19 @@ func (d *decoder) parseIFD(ifdOffset int64) (int64, error) {
 			if datatype != dtASCII {
 				return 0, FormatError(fmt.Sprintf("GeogASCIIParamsTag type: %v not recognised", datatype))
 			}
-			// The IFD contains a pointer to the real value.
-			raw := make([]byte, int(count))
-			d.ra.ReadAt(raw, int64(d.bo.Uint32(ifd[i+8:i+12])))
+			raw, err := d.values(tag, datatype, count, val)
+			if err != nil {
+				return 0, err
+			}
 			d.gt.aParams = string(raw)
 		case tGeoKeyDirectory:
 			if datatype != dtShort || count < 4 {
 				return 0, FormatError(fmt.Sprintf("GeoKeyDirectory type: %v or count: %d not recognised", datatype, count))
 			}
-			// The IFD contains a pointer to the real value.
-			raw := make([]byte, int(count)*2)
-			d.ra.ReadAt(raw, int64(d.bo.Uint32(ifd[i+8:i+12])))
+			raw, err := d.values(tag, datatype, count, val)
+			if err != nil {
+				return 0, err
+			}
 
 			data := make([]uint16, count)
 			for i := uint32(0); i < count; i++ {
@@ -347,9 +471,10 @@ func (d *decoder) parseIFD(ifdOffset int64) (int64, error) {
 			if datatype != dtFloat64 || count != 3 {
 				return 0, FormatError(fmt.Sprintf("ModelPixelScale type: %v or count: %d not recognised", datatype, count))
 			}
-			// The IFD contains a pointer to the real value.
-			raw := make([]byte, int(count)*8)
-			d.ra.ReadAt(raw, int64(d.bo.Uint32(ifd[i+8:i+12])))
+			raw, err := d.values(tag, datatype, count, val)
+			if err != nil {
+				return 0, err
+			}
 
 			pixelScale = make([]float64, count)
 			for i := uint32(0); i < count; i++ {
@@ -359,9 +484,10 @@ func (d *decoder) parseIFD(ifdOffset int64) (int64, error) {
 			if datatype != dtFloat64 {
 				return 0, FormatError(fmt.Sprintf("ModelTiePoint type: %v not recognised", datatype))
 			}
-			// The IFD contains a pointer to the real value.
-			raw := make([]byte, int(count)*8)
-			d.ra.ReadAt(raw, int64(d.bo.Uint32(ifd[i+8:i+12])))
+			raw, err := d.values(tag, datatype, count, val)
+			if err != nil {
+				return 0, err
+			}
 
 			tiePoint = make([]float64, count)
 			for i := uint32(0); i < count; i++ {
@@ -373,28 +499,60 @@ func (d *decoder) parseIFD(ifdOffset int64) (int64, error) {
 			if datatype != dtASCII {
 				return 0, FormatError(fmt.Sprintf("GDALNoDataTag type: %v not recognised", datatype))
 			}
-			// The IFD contains a pointer to the real value.
-			raw := make([]byte, int(count))
-			d.ra.ReadAt(raw, int64(d.bo.Uint32(ifd[i+8:i+12])))
-			var err error
-			d.gt.NoData, err = strconv.ParseFloat(string(bytes.Trim(raw, "\x00")), 64)
+			raw, err := d.values(tag, datatype, count, val)
+			if err != nil {
+				return 0, err
+			}
+			// GDAL writes NaN as "nan", which ParseFloat accepts.
+			d.gt.NoData, err = strconv.ParseFloat(string(bytes.TrimSpace(bytes.Trim(raw, "\x00"))), 64)
 			if err != nil {
 				// return 0, FormatError(fmt.Sprintf("GDAL NoData value %s cannot be parsed: %v", string(raw), err))
 				d.gt.NoData = 0
 			}
+			d.gt.HasNoData = err == nil
 		case tGDALMetadata:
 			if datatype != dtASCII {
 				return 0, FormatError(fmt.Sprintf("GDALMetadataTag type: %v not recognised", datatype))
 			}
-			// The IFD contains a pointer to the real value.
-			raw := make([]byte, int(count))
-			d.ra.ReadAt(raw, int64(d.bo.Uint32(ifd[i+8:i+12])))
+			raw, err := d.values(tag, datatype, count, val)
+			if err != nil {
+				return 0, err
+			}
 			d.gt.GDALMetadata = string(bytes.Trim(raw, "\x00"))
-		default:
-			nonCaptTags = append(nonCaptTags, tag)
 		}
+		// Other tags are of no use to the decoder and are skipped.
+	}
+
+	// Files may give BitsPerSample and SampleFormat once for all samples.
+	// Without BitsPerSample, samples are of a single bit, as for bilevel
+	// images.
+	if imgDesc.SamplesPerPixel == 0 {
+		imgDesc.SamplesPerPixel = 1
+	}
+	if imgDesc.BitsPerSample == nil {
+		imgDesc.BitsPerSample = []uint16{1}
+	}
+	imgDesc.BitsPerSample = perSample(imgDesc.BitsPerSample, imgDesc.SamplesPerPixel)
+	if len(imgDesc.BitsPerSample) != int(imgDesc.SamplesPerPixel) {
+		return 0, FormatError(fmt.Sprintf("BitsPerSample count: %d for %d samples per pixel", len(imgDesc.BitsPerSample), imgDesc.SamplesPerPixel))
+	}
+	imgDesc.SampleFormat = perSample(imgDesc.SampleFormat, imgDesc.SamplesPerPixel)
+	if imgDesc.PhotometricInterpr == pPaletted && imgDesc.BitsPerSample[0] <= 16 &&
+		len(imgDesc.ColorMap) != 3<<imgDesc.BitsPerSample[0] {
+		return 0, FormatError(fmt.Sprintf("ColorMap count: %d for BitsPerSample of %d", len(imgDesc.ColorMap), imgDesc.BitsPerSample[0]))
+	}
+
+	// Strips are read as tiles spanning the whole width of the image.
+	if imgDesc.TileWidth == 0 && stripOffsets != nil {
+		imgDesc.Stripped = true
+		imgDesc.TileWidth = imgDesc.ImageWidth
+		imgDesc.TileHeight = rowsPerStrip
+		if rowsPerStrip > imgDesc.ImageHeight {
+			imgDesc.TileHeight = imgDesc.ImageHeight
+		}
+		imgDesc.TileOffsets = stripOffsets
+		imgDesc.TileByteCounts = stripByteCounts
 	}
-	log.Println("non captured tag:", nonCaptTags)
 
 	if tiePoint != nil {
 		d.gt.GeoTrans[0] = tiePoint[3]
@@ -409,22 +567,95 @@ func (d *decoder) parseIFD(ifdOffset int64) (int64, error) {
 
 	d.gt.Overviews = append(d.gt.Overviews, imgDesc)
 
-	nextIFDOffset := ifdOffset + int64(2) + int64(numItems*12)
-	if _, err := d.ra.ReadAt(p[0:4], nextIFDOffset); err != nil {
-		return 0, FormatError("error reading IFD")
+	nextIFDOffset := ifdOffset + int64(numLen) + int64(numItems*entryLen)
+	if _, err := d.ra.ReadAt(p[0:d.offsetLen()], nextIFDOffset); err != nil {
+		return 0, readError(err, "error reading IFD")
 	}
-	ifdOffset = int64(d.bo.Uint32(p[:4]))
+	ifdOffset = int64(d.offset(p))
 
 	return ifdOffset, nil
 }
 
+// values returns the raw bytes of the count values of an IFD entry, given
+// the value field of the entry. Values that do not fit into the field are
+// read from where it points to.
+func (d *decoder) values(tag, datatype uint16, count uint32, val []byte) ([]byte, error) {
+	if int(datatype) >= len(lengths) || lengths[datatype] == 0 {
+		return nil, FormatError(fmt.Sprintf("tag %d type: %v not recognised", tag, datatype))
+	}
+	datalen := uint64(lengths[datatype]) * uint64(count)
+	if datalen <= uint64(d.offsetLen()) {
+		return val[:datalen], nil
+	}
+	if datalen > math.MaxInt32 {
+		return nil, FormatError(fmt.Sprintf("tag %d count: %d not recognised", tag, count))
+	}
+	// The IFD contains a pointer to the real value.
+	raw := make([]byte, datalen)
+	if _, err := d.ra.ReadAt(raw, int64(d.offset(val))); err != nil {
+		return nil, readError(err, fmt.Sprintf("error reading values of tag %d", tag))
+	}
+	return raw, nil
+}
+
+// shortValues returns the SHORT values of an IFD entry.
+func (d *decoder) shortValues(tag uint16, count uint32, val []byte) ([]uint16, error) {
+	raw, err := d.values(tag, dtShort, count, val)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]uint16, count)
+	for i := range data {
+		data[i] = d.bo.Uint16(raw[2*i : 2*(i+1)])
+	}
+	return data, nil
+}
+
+// perSample returns values repeated for each of n samples if it holds a
+// single value, and values itself otherwise.
+func perSample(values []uint16, n uint16) []uint16 {
+	if len(values) != 1 || n <= 1 {
+		return values
+	}
+	all := make([]uint16, n)
+	for i := range all {
+		all[i] = values[0]
+	}
+	return all
+}
+
+// uintValues returns the SHORT, LONG or LONG8 values of an IFD entry.
+func (d *decoder) uintValues(tag, datatype uint16, count uint32, val []byte) ([]uint64, error) {
+	if datatype != dtShort && datatype != dtLong && datatype != dtLong8 {
+		return nil, FormatError(fmt.Sprintf("tag %d type: %v not recognised", tag, datatype))
+	}
+	raw, err := d.values(tag, datatype, count, val)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]uint64, count)
+	for i := range data {
+		switch datatype {
+		case dtShort:
+			data[i] = uint64(d.bo.Uint16(raw[2*i : 2*(i+1)]))
+		case dtLong:
+			data[i] = uint64(d.bo.Uint32(raw[4*i : 4*(i+1)]))
+		case dtLong8:
+			data[i] = d.bo.Uint64(raw[8*i : 8*(i+1)])
+		}
+	}
+	return data, nil
+}
+
 func (d *decoder) readIFD() error {
 	var err error
-	p := make([]byte, 4)
-	if _, err = d.ra.ReadAt(p, 4); err != nil {
+	// The offset of the first IFD follows the header, which is 4 bytes
+	// long, or 8 in BigTIFF files.
+	p := make([]byte, d.offsetLen())
+	if _, err = d.ra.ReadAt(p, int64(len(p))); err != nil {
 		return err
 	}
-	ifdOffset := int64(d.bo.Uint32(p[0:4]))
+	ifdOffset := int64(d.offset(p))
 
 	for ifdOffset != 0 {
 		ifdOffset, err = d.parseIFD(ifdOffset)
@@ -442,10 +673,15 @@ func (d *decoder) dataType() (string, error) {
 	switch sampleFormat(cfg.SampleFormat[0]) {
 	case uintSample:
 		switch cfg.BitsPerSample[0] {
-		case 8:
+		case 1, 2, 4, 8:
+			// Samples of fewer than 8 bits are decoded as UInt8 too.
 			return "UInt8", nil
 		case 16:
 			return "UInt16", nil
+		case 32:
+			return "UInt32", nil
+		case 64:
+			return "UInt64", nil
 		}
 	case sintSample:
 		switch cfg.BitsPerSample[0] {
@@ -453,6 +689,17 @@ func (d *decoder) dataType() (string, error) {
 			return "Int8", nil
 		case 16:
 			return "Int16", nil
+		case 32:
+			return "Int32", nil
+		case 64:
+			return "Int64", nil
+		}
+	case ieeefpSample:
+		switch cfg.BitsPerSample[0] {
+		case 32:
+			return "Float32", nil
+		case 64:
+			return "Float64", nil
 		}
 	}
 
@@ -462,246 +709,653 @@ func (d *decoder) dataType() (string, error) {
 func (d *decoder) colorModel(level int) color.Model {
 	cfg := d.gt.Overviews[level]
 
-	// TODO get range in color modes dynamically from tiff file metadata?
-	switch cfg.PhotometricInterpr {
-	case pBlackIsZero:
-		switch sampleFormat(cfg.SampleFormat[0]) {
-		case uintSample:
-			switch cfg.BitsPerSample[0] {
-			case 8:
-				return scicolor.GrayU8Model{Max: 255}
-			case 16:
-				return scicolor.GrayU16Model{Max: 65535}
-			}
-		case sintSample:
-			switch cfg.BitsPerSample[0] {
-			case 8:
-				return scicolor.GrayS8Model{Min: -128, Max: 127}
-			case 16:
-				return scicolor.GrayS16Model{Min: -32768, Max: 32767}
-			}
-		}
+	dt, err := rasterDataType(cfg)
+	if err != nil {
+		return nil
 	}
-
-	return nil
+	return imageModel(dt, cfg)
 }
 
 // decode decodes the raw data of an image.
-// It reads from d.buf and writes the strip or tile into dst.
-func (d *decoder) decode(dst image.Image, level, xmin, ymin, xmax, ymax int) error {
+// It reads from buf and writes the strip or tile into dst. pick gives for
+// each band of dst the sample of the block's pixels to copy into it, or -1 to
+// leave the band alone. Temporary buffers are taken from sc.
+func (d *decoder) decode(sc *scratch, dst *Raster, buf []byte, level int, pick []int, xmin, ymin, xmax, ymax int) error {
 	cfg := d.gt.Overviews[level]
 
 	//Horizontal differencing encoding
 	if cfg.Predictor == 2 {
-		off := 0
+		// Each sample is stored as the difference to the same sample of the
+		// pixel to its left.
+		spp := blockSamples(cfg)
+		rowSamples := int(cfg.TileWidth) * spp
+		rowBytes := rowSamples * int(cfg.BitsPerSample[0]) / 8
+		// The last strip of an image may hold fewer rows than the others.
+		rows := int(cfg.TileHeight)
+		if rowBytes > 0 && len(buf)/rowBytes < rows {
+			rows = len(buf) / rowBytes
+		}
 		switch cfg.BitsPerSample[0] {
 		case 8:
-			for y := 0; y < int(cfg.TileHeight); y++ {
-				v0 := d.buf[off]
-				for x := 0; x < int(cfg.TileWidth); x++ {
-					off++
-					v1 := d.buf[off] + v0
-					d.buf[off] = v1
-					v0 = v1
+			for y := 0; y < rows; y++ {
+				row := buf[y*rowBytes : (y+1)*rowBytes]
+				for x := spp; x < rowSamples; x++ {
+					row[x] += row[x-spp]
 				}
-				off++
 			}
 		case 16:
-			for y := 0; y < int(cfg.TileHeight); y++ {
-				v0 := d.bo.Uint16(d.buf[off : off+2])
-				for x := 1; x < int(cfg.TileWidth); x++ {
-					off += 2
-					v1 := d.bo.Uint16(d.buf[off:off+2]) + v0
-					d.bo.PutUint16(d.buf[off:off+2], v1)
-					v0 = v1
+			for y := 0; y < rows; y++ {
+				row := buf[y*rowBytes : (y+1)*rowBytes]
+				for x := spp; x < rowSamples; x++ {
+					d.bo.PutUint16(row[2*x:], d.bo.Uint16(row[2*x:])+d.bo.Uint16(row[2*(x-spp):]))
+				}
+			}
+		case 32:
+			for y := 0; y < rows; y++ {
+				row := buf[y*rowBytes : (y+1)*rowBytes]
+				for x := spp; x < rowSamples; x++ {
+					d.bo.PutUint32(row[4*x:], d.bo.Uint32(row[4*x:])+d.bo.Uint32(row[4*(x-spp):]))
+				}
+			}
+		case 64:
+			for y := 0; y < rows; y++ {
+				row := buf[y*rowBytes : (y+1)*rowBytes]
+				for x := spp; x < rowSamples; x++ {
+					d.bo.PutUint64(row[8*x:], d.bo.Uint64(row[8*x:])+d.bo.Uint64(row[8*(x-spp):]))
 				}
-				off += 2
 			}
 		default:
-			return FormatError("Predictor not implemented for bit-sizes other than 8 or 16")
+			return FormatError("Predictor not implemented for bit-sizes other than 8, 16, 32 or 64")
+		}
+	}
+
+	// Floating point predictor
+	if cfg.Predictor == prFloatingPoint {
+		// The bytes of each row are differenced like 8-bit samples, after
+		// being rearranged so that the most significant bytes of all
+		// samples come first, then the next most significant ones and so on.
+		spp := blockSamples(cfg)
+		size := int(cfg.BitsPerSample[0]) / 8
+		if size != 4 && size != 8 {
+			return FormatError("floating point predictor not implemented for bit-sizes other than 32 or 64")
+		}
+		rowSamples := int(cfg.TileWidth) * spp
+		rowBytes := rowSamples * size
+		rows := int(cfg.TileHeight)
+		if len(buf)/rowBytes < rows {
+			rows = len(buf) / rowBytes
+		}
+		sc.tmp = grow(sc.tmp, rowBytes)
+		tmp := sc.tmp
+		for y := 0; y < rows; y++ {
+			row := buf[y*rowBytes : (y+1)*rowBytes]
+			for x := spp; x < rowBytes; x++ {
+				row[x] += row[x-spp]
+			}
+			copy(tmp, row)
+			// Put the bytes back in place, in the byte order of the file.
+			for k := 0; k < size; k++ {
+				to := k
+				if d.bo == binary.LittleEndian {
+					to = size - 1 - k
+				}
+				plane := tmp[k*rowSamples : (k+1)*rowSamples]
+				for x, b := range plane {
+					row[x*size+to] = b
+				}
+			}
 		}
 	}
 
-	rMaxX := minInt(xmax, dst.Bounds().Max.X)
-	rMaxY := minInt(ymax, dst.Bounds().Max.Y)
+	if bps := int(cfg.BitsPerSample[0]); bps < 8 {
+		sc.tmp = unpackSamples(sc.tmp, buf, bps, blockSamples(cfg)*(xmax-xmin), ymax-ymin)
+		buf = sc.tmp
+	}
+	bounds := image.Rect(0, 0, int(cfg.ImageWidth), int(cfg.ImageHeight))
+	return d.copySamples(dst, buf, blockSamples(cfg), pick, bounds, xmin, ymin, xmax, ymax)
+}
 
-	if cfg.SamplesPerPixel != 1 {
-		return FormatError("image data type not implemented")
+// copySamples copies samples of the block of pixels from (xmin, ymin) to
+// (xmax, ymax) in buf, which have spp samples each, to the part of r that it
+// covers within bounds, the bounds of the image. The padding of tiles beyond
+// the image is not copied. Sample pick[b] goes to band b of r, unless pick[b]
+// is -1.
+func (d *decoder) copySamples(r *Raster, buf []byte, spp int, pick []int, bounds image.Rectangle, xmin, ymin, xmax, ymax int) error {
+	size := r.DataType.Size()
+	rect := r.Rect.Intersect(image.Rect(xmin, ymin, xmax, ymax)).Intersect(bounds)
+	n := rect.Dx() * spp * size
+
+	// Whole rows can be copied if r holds all samples in their order.
+	all := spp == r.Bands
+	for b, p := range pick {
+		all = all && p == b
 	}
 
-	off := 0
-	switch img := dst.(type) {
-	case *scimage.GrayU8:
-		for y := ymin; y < rMaxY; y++ {
-			for x := xmin; x < rMaxX; x++ {
-				if off+1 > len(d.buf) {
-					return errNoPixels
-				}
-				v := uint8(d.buf[off+0])
-				off++
-				img.SetGrayU8(x, y, scicolor.GrayU8{Y: uint8(v), Min: img.Min, Max: img.Max, NoData: img.NoData})
-			}
-			if rMaxX == img.Bounds().Max.X {
-				off += xmax - img.Bounds().Max.X
-			}
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		src := ((y-ymin)*(xmax-xmin) + rect.Min.X - xmin) * spp * size
+		if src+n > len(buf) {
+			return errNoPixels
 		}
-	case *scimage.GrayU16:
-		for y := ymin; y < rMaxY; y++ {
-			for x := xmin; x < rMaxX; x++ {
-				if off+2 > len(d.buf) {
-					return errNoPixels
-				}
-				v := d.bo.Uint16(d.buf[off : off+2])
-				off += 2
-				img.SetGrayU16(x, y, scicolor.GrayU16{Y: v, Min: img.Min, Max: img.Max, NoData: img.NoData})
-			}
-			if rMaxX == img.Bounds().Max.X {
-				off += 2 * (xmax - img.Bounds().Max.X)
+		dst := r.PixOffset(rect.Min.X, y)
+		if all {
+			copy(r.Pix[dst:dst+n], buf[src:src+n])
+			if d.bo == binary.BigEndian {
+				swapBytes(r.Pix[dst:dst+n], size)
 			}
+			continue
 		}
-	case *scimage.GrayS8:
-		for y := ymin; y < rMaxY; y++ {
-			for x := xmin; x < rMaxX; x++ {
-				if off+1 > len(d.buf) {
-					return errNoPixels
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			for b, p := range pick {
+				if p < 0 {
+					continue
+				}
+				sample := r.Pix[dst+b*size : dst+(b+1)*size]
+				copy(sample, buf[src+p*size:])
+				if d.bo == binary.BigEndian {
+					swapBytes(sample, size)
 				}
-				v := int8(d.buf[off+0])
-				off++
-				img.SetGrayS8(x, y, scicolor.GrayS8{Y: int8(v), Min: img.Min, Max: img.Max, NoData: img.NoData})
-			}
-			if rMaxX == img.Bounds().Max.X {
-				off += xmax - img.Bounds().Max.X
 			}
+			src += spp * size
+			dst += r.Bands * size
 		}
-	case *scimage.GrayS16:
-		for y := ymin; y < rMaxY; y++ {
-			for x := xmin; x < rMaxX; x++ {
-				if off+2 > len(d.buf) {
-					return errNoPixels
+	}
+	return nil
+}
+
+// fillSamples sets the samples of r within rect to v, in the bands that pick,
+// as for copySamples, does not leave alone.
+func fillSamples(r *Raster, pick []int, rect image.Rectangle, v float64) {
+	rect = r.Rect.Intersect(rect)
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			for b, p := range pick {
+				if p >= 0 {
+					r.SetFloat64(b, x, y, v)
 				}
-				v := int16(d.bo.Uint16(d.buf[off : off+2]))
-				off += 2
-				img.SetGrayS16(x, y, scicolor.GrayS16{Y: v, Min: img.Min, Max: img.Max, NoData: img.NoData})
-			}
-			if rMaxX == img.Bounds().Max.X {
-				off += 2 * (xmax - img.Bounds().Max.X)
 			}
 		}
-	default:
-		return FormatError("malformed header")
 	}
+}
+
+// unpackSamples returns the samples of bps bits packed into buf, rows of n
+// samples each, as one byte per sample in the memory of dst. Each row of buf
+// starts on a new byte, the first sample in its most significant bits.
+func unpackSamples(dst, buf []byte, bps, n, rows int) []byte {
+	rowBytes := (n*bps + 7) / 8
+	if len(buf)/rowBytes < rows {
+		rows = len(buf) / rowBytes
+	}
+	mask := byte(1<<bps - 1)
+	out := grow(dst, n*rows)
+	for y := 0; y < rows; y++ {
+		row := buf[y*rowBytes : (y+1)*rowBytes]
+		for x := 0; x < n; x++ {
+			bit := x * bps
+			out[y*n+x] = row[bit/8] >> (8 - bps - bit%8) & mask
+		}
+	}
+	return out
+}
 
-	return nil
+// blockSamples returns the number of samples of each pixel in the tiles or
+// strips of the image described by cfg.
+func blockSamples(cfg ImgDesc) int {
+	if cfg.PlanarConfiguration == 2 {
+		return 1
+	}
+	return int(cfg.SamplesPerPixel)
+}
+
+// swapBytes reverses the byte order of each of the samples of the given
+// size in p.
+func swapBytes(p []byte, size int) {
+	for i := 0; i+size <= len(p); i += size {
+		for a, b := i, i+size-1; a < b; a, b = a+1, b-1 {
+			p[a], p[b] = p[b], p[a]
+		}
+	}
 }
 
-func decodeLevelSubImage(d decoder, level int, rect image.Rectangle) (img image.Image, err error) {
+// decodeLevelSubImage decodes the part of the image at the given level that
+// falls within rect, reading and decompressing up to parallelism tiles at
+// once. The Raster it decodes into is returned as an image.Image as
+// rasterImage describes.
+func decodeLevelSubImage(d decoder, level int, rect image.Rectangle, parallelism int) (img image.Image, err error) {
+	r, err := readRaster(d, level, rect, nil, parallelism)
+	if err != nil {
+		return nil, err
+	}
+	return rasterImage(r, d.gt.Overviews[level]), nil
+}
+
+// readRaster decodes the given bands of the part of the image at the given
+// level that falls within rect into a Raster, or all bands if bands is nil.
+func readRaster(d decoder, level int, rect image.Rectangle, bands []int, parallelism int) (*Raster, error) {
 	cfg := d.gt.Overviews[level]
 
-	blockPadding := false
-	blocksAcross := 1
-	blocksDown := 1
+	imgRect, err := subImageRect(cfg, rect)
+	if err != nil {
+		return nil, err
+	}
+	dt, err := rasterDataType(cfg)
+	if err != nil {
+		return nil, err
+	}
+	bands, err = rasterBands(cfg, bands)
+	if err != nil {
+		return nil, err
+	}
+	r := NewRaster(imgRect, len(bands), dt)
+	if err := readRasterInto(d, level, r, bands, parallelism); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
 
-	if cfg.ImageWidth == 0 || cfg.ImageHeight == 0 {
-		return nil, FormatError("unexpected image dimensions")
+// readRasterInto decodes the given bands of the part of the image at the
+// given level that dst covers into dst, or all bands if bands is nil. Pixels
+// of dst outside the image are left alone.
+func readRasterInto(d decoder, level int, dst *Raster, bands []int, parallelism int) error {
+	cfg := d.gt.Overviews[level]
+
+	if _, err := subImageRect(cfg, dst.Rect); err != nil {
+		return err
+	}
+	dt, err := rasterDataType(cfg)
+	if err != nil {
+		return err
 	}
+	if dst.DataType != dt {
+		return fmt.Errorf("raster of %v samples cannot hold %v samples", dst.DataType, dt)
+	}
+	bands, err = rasterBands(cfg, bands)
+	if err != nil {
+		return err
+	}
+	if dst.Bands != len(bands) {
+		return fmt.Errorf("raster of %d bands cannot hold %d bands", dst.Bands, len(bands))
+	}
+	if n := (dst.Rect.Dy()-1)*dst.Stride + dst.Rect.Dx()*dst.Bands*dt.Size(); len(dst.Pix) < n {
+		return fmt.Errorf("raster holds %d bytes of pixels, needs %d", len(dst.Pix), n)
+	}
+	dst.NoData, dst.HasNoData = d.gt.NoData, d.gt.HasNoData
+
+	return decodeBlocks(d, level, dst, bands, parallelism)
+}
 
-	if cfg.TileWidth != 0 {
-		blockPadding = true
-		blocksAcross = int((cfg.ImageWidth + cfg.TileWidth - 1) / cfg.TileWidth)
-		if cfg.TileHeight != 0 {
-			blocksDown = int((cfg.ImageHeight + cfg.TileHeight - 1) / cfg.TileHeight)
+// rasterBands checks that bands are bands of the image described by cfg and
+// returns them, or all bands of the image if there are none.
+func rasterBands(cfg ImgDesc, bands []int) ([]int, error) {
+	if len(bands) == 0 {
+		bands = make([]int, cfg.SamplesPerPixel)
+		for b := range bands {
+			bands[b] = b
+		}
+	}
+	for _, b := range bands {
+		if b < 0 || b >= int(cfg.SamplesPerPixel) {
+			return nil, fmt.Errorf("band %d not in image of %d bands", b, cfg.SamplesPerPixel)
 		}
 	}
+	return bands, nil
+}
+
+// subImageRect checks that the image described by cfg can be decoded and
+// returns the part of it that falls within rect.
+func subImageRect(cfg ImgDesc, rect image.Rectangle) (image.Rectangle, error) {
+	if cfg.ImageWidth == 0 || cfg.ImageHeight == 0 {
+		return image.Rectangle{}, FormatError("unexpected image dimensions")
+	}
+
+	if cfg.TileWidth == 0 || cfg.TileHeight == 0 {
+		return image.Rectangle{}, FormatError("image has neither tiles nor strips")
+	}
+	blocksAcross, blocksDown := tileGrid(cfg)
 
 	// Check if we have the right number of strips/tiles, offsets and counts.
-	if n := blocksAcross * blocksDown; len(cfg.TileOffsets) < n || len(cfg.TileByteCounts) < n {
-		return nil, FormatError("inconsistent header")
+	n := blocksAcross * blocksDown
+	if cfg.PlanarConfiguration == 2 {
+		n *= int(cfg.SamplesPerPixel)
+	}
+	if len(cfg.TileOffsets) < n || len(cfg.TileByteCounts) < n {
+		return image.Rectangle{}, FormatError("inconsistent header")
 	}
 
-	switch cfg.BitsPerSample[0] {
-	case 0:
-		return nil, FormatError("BitsPerSample must not be 0")
-	case 8, 16:
-		// Nothing to do, these are accepted by this implementation.
-	default:
-		return nil, UnsupportedError(fmt.Sprintf("BitsPerSample of %v", cfg.BitsPerSample))
+	for _, bps := range cfg.BitsPerSample {
+		switch bps {
+		case 0:
+			return image.Rectangle{}, FormatError("BitsPerSample must not be 0")
+		case 1, 2, 4, 8, 16, 32, 64:
+			// Nothing to do, these are accepted by this implementation.
+		default:
+			return image.Rectangle{}, UnsupportedError(fmt.Sprintf("BitsPerSample of %v", cfg.BitsPerSample))
+		}
 	}
 
 	imgRect := image.Rect(0, 0, int(cfg.ImageWidth), int(cfg.ImageHeight)).Intersect(rect)
 	if imgRect.Empty() {
-		return nil, fmt.Errorf("the rectangle provided does not intersect the image")
-	}
-
-	switch v := d.colorModel(level).(type) {
-	case scicolor.GrayU8Model:
-		img = scimage.NewGrayU8(imgRect, v.Min, v.Max, v.NoData)
-	case scicolor.GrayU16Model:
-		img = scimage.NewGrayU16(imgRect, v.Min, v.Max, v.NoData)
-	case scicolor.GrayS8Model:
-		img = scimage.NewGrayS8(imgRect, v.Min, v.Max, v.NoData)
-	case scicolor.GrayS16Model:
-		img = scimage.NewGrayS16(imgRect, v.Min, v.Max, v.NoData)
-	default:
-		return nil, FormatError("image data type not implemented")
+		return image.Rectangle{}, fmt.Errorf("the rectangle provided does not intersect the image")
 	}
+	return imgRect, nil
+}
 
-	for i := imgRect.Bounds().Min.X / int(cfg.TileWidth); i <= imgRect.Bounds().Max.X/int(cfg.TileWidth); i++ {
+// decodeBlocks decodes the tiles or strips of the image at the given level
+// that overlap img into img, up to parallelism of them at once. bands gives
+// for each band of img the band of the image to decode into it. Of
+// band-separate images, only the tiles of these bands are read. Tiles the
+// file leaves out, as GDAL does for sparse images, are filled with NoData, or
+// zero if the image has none.
+func decodeBlocks(d decoder, level int, img *Raster, bands []int, parallelism int) (err error) {
+	cfg := d.gt.Overviews[level]
+	imgRect := img.Rect.Intersect(image.Rect(0, 0, int(cfg.ImageWidth), int(cfg.ImageHeight)))
+	if imgRect.Empty() {
+		return nil
+	}
+
+	// Tiles are padded to their full size, strips are not.
+	blockPadding := !cfg.Stripped
+	blocksAcross, blocksDown := tileGrid(cfg)
+
+	// picks[p] tells decode which samples of the tiles of plane p go to which
+	// band of img. Pixel-interleaved images have a single plane holding all
+	// bands, band-separate ones a plane per band.
+	picks := map[int][]int{0: bands}
+	if cfg.PlanarConfiguration == 2 {
+		picks = map[int][]int{}
+		for b, band := range bands {
+			if picks[band] == nil {
+				picks[band] = make([]int, len(bands))
+				for i := range picks[band] {
+					picks[band][i] = -1
+				}
+			}
+			picks[band][b] = 0
+		}
+	}
+
+	// Collect the tiles covering imgRect, plane by plane and row by row so
+	// that they are in the order COGs store them.
+	var tiles []tileRef
+	for p := 0; p < int(cfg.SamplesPerPixel); p++ {
+		if _, ok := picks[p]; !ok {
+			continue
+		}
+		first := p * blocksAcross * blocksDown
+		for j := imgRect.Min.Y / int(cfg.TileHeight); j <= (imgRect.Max.Y-1)/int(cfg.TileHeight); j++ {
+			for i := imgRect.Min.X / int(cfg.TileWidth); i <= (imgRect.Max.X-1)/int(cfg.TileWidth); i++ {
+				k := first + j*blocksAcross + i
+				tiles = append(tiles, tileRef{i, j, p, int64(cfg.TileOffsets[k]), int64(cfg.TileByteCounts[k])})
+			}
+		}
+	}
+
+	// The size of a decompressed tile, or of a full strip.
+	blockBytes := (int(cfg.TileWidth)*blockSamples(cfg)*int(cfg.BitsPerSample[0]) + 7) / 8 * int(cfg.TileHeight)
+
+	// Readers that can serve several ranges at once get all tiles in one go.
+	// Only their data as stored is kept for all tiles, one after the other
+	// in the buffer of a single scratch; they are decompressed one by one in
+	// the scratch of the goroutine decoding them, so that no more than
+	// parallelism tiles are held decompressed at once.
+	var raw [][]byte
+	if mr, ok := d.ra.(multiReaderAt); ok && len(tiles) > 1 {
+		total := 0
+		for _, t := range tiles {
+			total += int(t.n)
+		}
+		rs := getScratch()
+		defer putScratch(rs)
+		rs.raw = grow(rs.raw, total)
+		raw = make([][]byte, len(tiles))
+		offs := make([]int64, len(tiles))
+		pos := 0
+		for k, t := range tiles {
+			raw[k] = rs.raw[pos : pos+int(t.n) : pos+int(t.n)]
+			offs[k] = t.offset
+			pos += int(t.n)
+		}
+		if _, err = mr.ReadAtMulti("", raw, offs); err != nil {
+			return err
+		}
+	}
+
+	return forEach(len(tiles), parallelism, func(k int) error {
+		t := tiles[k]
 		blkW := int(cfg.TileWidth)
-		if !blockPadding && i == blocksAcross-1 && cfg.ImageWidth%cfg.TileWidth != 0 {
+		if !blockPadding && t.i == blocksAcross-1 && cfg.ImageWidth%cfg.TileWidth != 0 {
 			blkW = int(cfg.ImageWidth % cfg.TileWidth)
 		}
-		for j := imgRect.Bounds().Min.Y / int(cfg.TileWidth); j <= imgRect.Bounds().Max.Y/int(cfg.TileWidth); j++ {
-			blkH := int(cfg.TileHeight)
-			if !blockPadding && j == blocksDown-1 && cfg.ImageHeight%cfg.TileHeight != 0 {
-				blkH = int(cfg.ImageHeight % cfg.TileHeight)
-			}
-			offset := int64(cfg.TileOffsets[j*blocksAcross+i])
-			n := int64(cfg.TileByteCounts[j*blocksAcross+i])
-			switch cfg.Compression {
-
-			// According to the spec, Compression does not have a default value,
-			// but some tools interpret a missing Compression value as none so we do
-			// the same.
-			case cNone, 0:
-				if b, ok := d.ra.(*buffer); ok {
-					d.buf, err = b.Slice(int(offset), int(n))
-				} else {
-					d.buf = make([]byte, n)
-					_, err = d.ra.ReadAt(d.buf, offset)
+		blkH := int(cfg.TileHeight)
+		if !blockPadding && t.j == blocksDown-1 && cfg.ImageHeight%cfg.TileHeight != 0 {
+			blkH = int(cfg.ImageHeight % cfg.TileHeight)
+		}
+
+		xmin := t.i * int(cfg.TileWidth)
+		ymin := t.j * int(cfg.TileHeight)
+		xmax := xmin + blkW
+		ymax := ymin + blkH
+
+		if t.n == 0 {
+			fillSamples(img, picks[t.band], image.Rect(xmin, ymin, xmax, ymax).Intersect(imgRect), d.gt.NoData)
+			return nil
+		}
+
+		var buf []byte
+		var err error
+		sc := getScratch()
+		defer putScratch(sc)
+		if raw != nil {
+			buf, err = d.readTile(sc, bytes.NewReader(raw[k]), 0, t.n, cfg, blockBytes)
+		} else {
+			buf, err = d.readTile(sc, d.ra, t.offset, t.n, cfg, blockBytes)
+		}
+		if err != nil {
+			return err
+		}
+
+		// Tiles do not overlap, so concurrent calls write disjoint pixels.
+		return d.decode(sc, img, buf, level, picks[t.band], xmin, ymin, xmax, ymax)
+	})
+}
+
+// forEach calls f with 0 to n-1, from at most parallelism goroutines at once,
+// and returns the first error f returns. Once f failed, no further calls are
+// started.
+func forEach(n, parallelism int, f func(k int) error) error {
+	if parallelism > n {
+		parallelism = n
+	}
+	if parallelism <= 1 {
+		for k := 0; k < n; k++ {
+			if err := f(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex // guards next and firstErr
+	next := 0
+	var firstErr error
+	for w := 0; w < parallelism; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				mu.Lock()
+				if firstErr != nil || next >= n {
+					mu.Unlock()
+					return
 				}
-			case cLZW:
-				r := lzw.NewReader(io.NewSectionReader(d.ra, offset, n), lzw.MSB, 8)
-				d.buf, err = ioutil.ReadAll(r)
-				r.Close()
-			case cDeflate, cDeflateOld:
-				var r io.ReadCloser
-				r, err = zlib.NewReader(io.NewSectionReader(d.ra, offset, n))
-				if err != nil {
-					return nil, err
+				k := next
+				next++
+				mu.Unlock()
+
+				if err := f(k); err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+					return
 				}
-				d.buf, err = ioutil.ReadAll(r)
-				r.Close()
-			case cPackBits:
-				d.buf, err = unpackBits(io.NewSectionReader(d.ra, offset, n))
-			default:
-				err = UnsupportedError(fmt.Sprintf("compression value %d", cfg.Compression))
-			}
-			if err != nil {
-				return nil, err
 			}
+		}()
+	}
+	wg.Wait()
+	return firstErr
+}
 
-			xmin := i * int(cfg.TileWidth)
-			ymin := j * int(cfg.TileHeight)
-			xmax := xmin + blkW
-			ymax := ymin + blkH
+// readTile reads the n bytes of data at offset from ra of a tile of the image
+// described by cfg and returns them decompressed, in the buffers of sc, which
+// are expected to receive size bytes. Except for uncompressed tiles read from
+// a buffer, the result is only valid until sc is used again.
+func (d *decoder) readTile(sc *scratch, ra io.ReaderAt, offset, n int64, cfg ImgDesc, size int) (buf []byte, err error) {
+	if cap(sc.data) < size {
+		sc.data = make([]byte, 0, size)
+	}
+	switch compression := cfg.Compression; compression {
+
+	// According to the spec, Compression does not have a default value,
+	// but some tools interpret a missing Compression value as none so we do
+	// the same.
+	case cNone, 0:
+		if b, ok := ra.(*buffer); ok {
+			buf, err = b.Slice(int(offset), int(n))
+		} else {
+			sc.data = grow(sc.data, int(n))
+			buf = sc.data
+			_, err = ra.ReadAt(buf, offset)
+		}
+	case cLZW:
+		r := sc.lzwReader(sc.reader(ra, offset, n))
+		sc.data, err = readAll(sc.data, r)
+		buf = sc.data
+		r.Close()
+	case cDeflate, cDeflateOld:
+		var r io.ReadCloser
+		r, err = sc.zlibReader(sc.reader(ra, offset, n))
+		if err != nil {
+			return nil, err
+		}
+		sc.data, err = readAll(sc.data, r)
+		buf = sc.data
+		r.Close()
+	case cPackBits:
+		sc.data, err = unpackBits(sc.data, sc.reader(ra, offset, n))
+		buf = sc.data
+	case cZSTD:
+		sc.data, err = readAll(sc.data, sc.zstdReader(sc.reader(ra, offset, n)))
+		buf = sc.data
+	case cLERC:
+		buf, err = d.readLERC(sc, ra, offset, n, cfg)
+	default:
+		err = UnsupportedError(fmt.Sprintf("compression value %d", compression))
+	}
+	return buf, err
+}
 
-			err = d.decode(img, level, xmin, ymin, xmax, ymax)
-			if err != nil {
+// readLERC reads the n bytes of data at offset from ra of a LERC compressed
+// tile of the image described by cfg and returns them decoded, in the buffers
+// of sc. The tile holds a Lerc2 blob for all samples of its pixels, or one
+// blob after the other for each sample. An unassociated alpha band of 8-bit
+// images may be left out of the blobs and stored as their mask.
+func (d *decoder) readLERC(sc *scratch, ra io.ReaderAt, offset, n int64, cfg ImgDesc) ([]byte, error) {
+	var err error
+	add := uint32(lercAddNone)
+	if len(cfg.LercParameters) > 1 {
+		add = cfg.LercParameters[1]
+	}
+	switch add {
+	case lercAddNone:
+		sc.tmp = grow(sc.tmp, int(n))
+		_, err = io.ReadFull(sc.reader(ra, offset, n), sc.tmp)
+	case lercAddDeflate:
+		var r io.ReadCloser
+		if r, err = sc.zlibReader(sc.reader(ra, offset, n)); err == nil {
+			sc.tmp, err = readAll(sc.tmp, r)
+		}
+	case lercAddZSTD:
+		sc.tmp, err = readAll(sc.tmp, sc.zstdReader(sc.reader(ra, offset, n)))
+	default:
+		return nil, UnsupportedError(fmt.Sprintf("compression value %d on top of LERC", add))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := lerc.DecodeInfo(sc.tmp)
+	if err != nil {
+		return nil, err
+	}
+	if info.Width != int(cfg.TileWidth) || info.Height > int(cfg.TileHeight) {
+		return nil, FormatError(fmt.Sprintf("LERC blob of %dx%d pixels in tile of %dx%d", info.Width, info.Height, cfg.TileWidth, cfg.TileHeight))
+	}
+	if !lercMatches(info.DataType, cfg) {
+		return nil, FormatError("LERC data type does not match the samples of the image")
+	}
+	spp := blockSamples(cfg)
+	sc.data = grow(sc.data, info.Width*info.Height*spp*info.DataType.Size())
+	src := sc.tmp
+	for first := 0; first < spp; {
+		if first == spp-1 && len(src) == 0 && lercAlphaMask(info.DataType, cfg) {
+			// The blobs left the alpha band out, which is their mask.
+			if _, err := lerc.DecodeMask(sc.data, spp, first, sc.tmp); err != nil {
 				return nil, err
 			}
+			break
 		}
+		blob, err := lerc.Decode(sc.data, spp, first, d.bo, src)
+		if err != nil {
+			return nil, err
+		}
+		if blob.Width != info.Width || blob.Height != info.Height || blob.DataType != info.DataType {
+			return nil, FormatError("LERC blobs of a tile differ")
+		}
+		src = src[blob.BlobSize:]
+		first += blob.Depth
 	}
-	return
+	return sc.data, nil
+}
+
+// lercAlphaMask tells whether LERC blobs of type t may store the last sample
+// of the pixels of the image described by cfg as their mask, as libtiff does
+// for an unassociated alpha band of 8-bit images.
+func lercAlphaMask(t lerc.DataType, cfg ImgDesc) bool {
+	n := len(cfg.ExtraSamples)
+	return t == lerc.Byte && cfg.PlanarConfiguration != 2 && n > 0 && cfg.ExtraSamples[n-1] == 2
+}
+
+// lercMatches tells whether LERC values of type t are samples of the image
+// described by cfg.
+func lercMatches(t lerc.DataType, cfg ImgDesc) bool {
+	if len(cfg.BitsPerSample) == 0 {
+		return false
+	}
+	sf := uintSample
+	if len(cfg.SampleFormat) > 0 {
+		sf = sampleFormat(cfg.SampleFormat[0])
+	}
+	switch bps := cfg.BitsPerSample[0]; t {
+	case lerc.Char:
+		return bps == 8 && sf == sintSample
+	case lerc.Byte:
+		return bps == 8 && sf == uintSample
+	case lerc.Short:
+		return bps == 16 && sf == sintSample
+	case lerc.UShort:
+		return bps == 16 && sf == uintSample
+	case lerc.Int:
+		return bps == 32 && sf == sintSample
+	case lerc.UInt:
+		return bps == 32 && sf == uintSample
+	case lerc.Float:
+		return bps == 32 && sf == ieeefpSample
+	case lerc.Double:
+		return bps == 64 && sf == ieeefpSample
+	}
+	return false
 }
 
 func DecodeLevelSubImage(r io.Reader, level int, rect image.Rectangle) (img image.Image, err error) {
@@ -714,7 +1368,7 @@ func DecodeLevelSubImage(r io.Reader, level int, rect image.Rectangle) (img imag
 		return nil, err
 	}
 
-	return decodeLevelSubImage(d, level, rect)
+	return decodeLevelSubImage(d, level, rect, 1)
 }
 
 func DecodeLevel(r io.Reader, level int) (img image.Image, err error) {
@@ -730,7 +1384,7 @@ func DecodeLevel(r io.Reader, level int) (img image.Image, err error) {
 	cfg := d.gt.Overviews[level]
 	rect := image.Rect(0, 0, int(cfg.ImageWidth), int(cfg.ImageHeight))
 
-	return decodeLevelSubImage(d, level, rect)
+	return decodeLevelSubImage(d, level, rect, 1)
 }
 
 func Decode(r io.Reader) (img image.Image, err error) {
@@ -746,7 +1400,7 @@ func Decode(r io.Reader) (img image.Image, err error) {
 	cfg := d.gt.Overviews[0]
 	rect := image.Rect(0, 0, int(cfg.ImageWidth), int(cfg.ImageHeight))
 
-	return decodeLevelSubImage(d, 0, rect)
+	return decodeLevelSubImage(d, 0, rect, 1)
 }
 
 func DecodeGeoInfo(r io.Reader) (GeoInfo, error) {
@@ -759,6 +1413,10 @@ func DecodeGeoInfo(r io.Reader) (GeoInfo, error) {
 		return GeoInfo{}, err
 	}
 
+	return d.geoInfo()
+}
+
+func (d *decoder) geoInfo() (GeoInfo, error) {
 	dType, err := d.dataType()
 	if err != nil {
 		return GeoInfo{}, err
@@ -769,9 +1427,13 @@ func DecodeGeoInfo(r io.Reader) (GeoInfo, error) {
 		return GeoInfo{}, err
 	}
 
-	info := GeoInfo{Type: dType, Size: [2]uint32{d.gt.Overviews[0].ImageWidth, d.gt.Overviews[0].ImageHeight},
+	info := GeoInfo{Type: dType, Bands: int(d.gt.Overviews[0].SamplesPerPixel), Size: [2]uint32{d.gt.Overviews[0].ImageWidth, d.gt.Overviews[0].ImageHeight},
 		GeoTrans: d.gt.GeoTrans, Proj4: proj4, NoData: d.gt.NoData}
 
+	if bps := d.gt.Overviews[0].BitsPerSample[0]; bps < 8 {
+		info.NBits = int(bps)
+	}
+
 	for i := 0; i < len(d.gt.Overviews); i++ {
 		info.Overviews = append(info.Overviews, Overview{Size: [2]uint32{d.gt.Overviews[i].ImageWidth,
 			d.gt.Overviews[i].ImageHeight}})
@@ -789,9 +1451,14 @@ func DecodeConfigLevel(r io.Reader, level int) (image.Config, error) {
 	if err != nil {
 		return image.Config{}, err
 	}
+
+	return d.config(level), nil
+}
+
+func (d *decoder) config(level int) image.Config {
 	cfg := d.gt.Overviews[level]
 
-	return image.Config{ColorModel: d.colorModel(level), Width: int(cfg.ImageWidth), Height: int(cfg.ImageHeight)}, nil
+	return image.Config{ColorModel: d.colorModel(level), Width: int(cfg.ImageWidth), Height: int(cfg.ImageHeight)}
 }
 
 // DecodeConfig returns the color model and dimensions of a TIFF image without
@@ -803,4 +1470,6 @@ func DecodeConfig(r io.Reader) (image.Config, error) {
 func init() {
 	image.RegisterFormat("cog", leHeader, Decode, DecodeConfig)
 	image.RegisterFormat("cog", beHeader, Decode, DecodeConfig)
+	image.RegisterFormat("cog", leBigHeader, Decode, DecodeConfig)
+	image.RegisterFormat("cog", beBigHeader, Decode, DecodeConfig)
 }
@@ -0,0 +1,124 @@
+package gocog
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// Sample is the set of Go types the samples of a Raster can be read as.
+type Sample interface {
+	uint8 | int8 | uint16 | int16 | uint32 | int32 | uint64 | int64 | float32 | float64
+}
+
+// DataTypeOf returns the DataType whose samples have type T.
+func DataTypeOf[T Sample]() DataType {
+	var v T
+	switch any(v).(type) {
+	case uint8:
+		return UInt8
+	case int8:
+		return Int8
+	case uint16:
+		return UInt16
+	case int16:
+		return Int16
+	case uint32:
+		return UInt32
+	case int32:
+		return Int32
+	case uint64:
+		return UInt64
+	case int64:
+		return Int64
+	case float32:
+		return Float32
+	}
+	return Float64
+}
+
+// Samples returns all samples of r converted to T, row by row with the
+// samples of each pixel following each other band by band. Converting to the
+// DataType of r, see DataTypeOf, is lossless.
+func Samples[T Sample](r *Raster) []T {
+	w, h := r.Rect.Dx(), r.Rect.Dy()
+	dst := make([]T, w*h*r.Bands)
+	for y := 0; y < h; y++ {
+		row := dst[y*w*r.Bands : (y+1)*w*r.Bands]
+		convertSamples(row, r.Pix[y*r.Stride:], r.DataType, 1)
+	}
+	return dst
+}
+
+// BandSamples returns the samples of band b of r converted to T, row by row.
+func BandSamples[T Sample](r *Raster, b int) ([]T, error) {
+	if b < 0 || b >= r.Bands {
+		return nil, fmt.Errorf("band %d not in raster of %d bands", b, r.Bands)
+	}
+	w, h := r.Rect.Dx(), r.Rect.Dy()
+	dst := make([]T, w*h)
+	for y := 0; y < h; y++ {
+		convertSamples(dst[y*w:(y+1)*w], r.Pix[y*r.Stride+b*r.DataType.Size():], r.DataType, r.Bands)
+	}
+	return dst, nil
+}
+
+// SampleAt returns the sample of band b at (x, y) converted to T, or zero if
+// there is no such sample.
+func SampleAt[T Sample](r *Raster, b, x, y int) T {
+	var v [1]T
+	if b < 0 || b >= r.Bands || x < r.Rect.Min.X || x >= r.Rect.Max.X || y < r.Rect.Min.Y || y >= r.Rect.Max.Y {
+		return v[0]
+	}
+	convertSamples(v[:], r.Pix[r.PixOffset(x, y)+b*r.DataType.Size():], r.DataType, 1)
+	return v[0]
+}
+
+// convertSamples fills dst with samples of type t read from src, where they
+// are stored in little-endian byte order step samples apart.
+func convertSamples[T Sample](dst []T, src []byte, t DataType, step int) {
+	le := binary.LittleEndian
+	step *= t.Size()
+	switch t {
+	case UInt8:
+		for i := range dst {
+			dst[i] = T(src[i*step])
+		}
+	case Int8:
+		for i := range dst {
+			dst[i] = T(int8(src[i*step]))
+		}
+	case UInt16:
+		for i := range dst {
+			dst[i] = T(le.Uint16(src[i*step:]))
+		}
+	case Int16:
+		for i := range dst {
+			dst[i] = T(int16(le.Uint16(src[i*step:])))
+		}
+	case UInt32:
+		for i := range dst {
+			dst[i] = T(le.Uint32(src[i*step:]))
+		}
+	case Int32:
+		for i := range dst {
+			dst[i] = T(int32(le.Uint32(src[i*step:])))
+		}
+	case UInt64:
+		for i := range dst {
+			dst[i] = T(le.Uint64(src[i*step:]))
+		}
+	case Int64:
+		for i := range dst {
+			dst[i] = T(int64(le.Uint64(src[i*step:])))
+		}
+	case Float32:
+		for i := range dst {
+			dst[i] = T(math.Float32frombits(le.Uint32(src[i*step:])))
+		}
+	case Float64:
+		for i := range dst {
+			dst[i] = T(math.Float64frombits(le.Uint64(src[i*step:])))
+		}
+	}
+}
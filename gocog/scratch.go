@@ -0,0 +1,124 @@
+package gocog
+
+import (
+	"bufio"
+	"compress/zlib"
+	"io"
+	"sync"
+
+	"gocog/gocog/lzw"
+	"gocog/gocog/zstd"
+)
+
+// scratch holds the buffers and decompressors needed to decode one tile or
+// strip. They are reused from one tile to the next through scratchPool, so
+// that decoding many tiles does not allocate for each of them.
+type scratch struct {
+	raw  []byte // Data as stored in the file.
+	data []byte // Decompressed data.
+	tmp  []byte // Rows being rearranged or unpacked, or a LERC blob.
+	pix  []byte // Pixels of a Raster only used during a call.
+
+	sr io.SectionReader
+	br *bufio.Reader
+	zr io.ReadCloser // zlib decompressor, nil until first needed.
+	lr io.ReadCloser // LZW decompressor, nil until first needed.
+	zs *zstd.Reader  // Zstandard decompressor, nil until first needed.
+}
+
+var scratchPool = sync.Pool{New: func() any { return new(scratch) }}
+
+// maxPooledRaw bounds the memory of each of the buffers a scratch keeps in
+// scratchPool. Reads of several ranges at once put the data of all their
+// tiles into raw, and large reads into a single Raster need as large a pix;
+// the memory would otherwise stay pinned by the pool after such a read.
+const maxPooledRaw = 8 << 20
+
+func getScratch() *scratch {
+	return scratchPool.Get().(*scratch)
+}
+
+func putScratch(s *scratch) {
+	for _, b := range []*[]byte{&s.raw, &s.data, &s.tmp, &s.pix} {
+		if cap(*b) > maxPooledRaw {
+			*b = nil
+		}
+	}
+	s.sr = io.SectionReader{}
+	if s.br != nil {
+		s.br.Reset(nil)
+	}
+	scratchPool.Put(s)
+}
+
+// reader returns a buffered reader of the n bytes at offset in ra.
+func (s *scratch) reader(ra io.ReaderAt, offset, n int64) *bufio.Reader {
+	s.sr = *io.NewSectionReader(ra, offset, n)
+	if s.br == nil {
+		s.br = bufio.NewReader(&s.sr)
+	} else {
+		s.br.Reset(&s.sr)
+	}
+	return s.br
+}
+
+// zlibReader returns a zlib decompressor reading from r.
+func (s *scratch) zlibReader(r io.Reader) (io.ReadCloser, error) {
+	if s.zr == nil {
+		zr, err := zlib.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		s.zr = zr
+		return zr, nil
+	}
+	return s.zr, s.zr.(zlib.Resetter).Reset(r, nil)
+}
+
+// lzwReader returns an LZW decompressor, as TIFF uses it, reading from r.
+func (s *scratch) lzwReader(r io.Reader) io.ReadCloser {
+	if s.lr == nil {
+		s.lr = lzw.NewReader(r, lzw.MSB, 8)
+	} else {
+		s.lr.(lzw.Resetter).Reset(r, lzw.MSB, 8)
+	}
+	return s.lr
+}
+
+// zstdReader returns a Zstandard decompressor reading from r.
+func (s *scratch) zstdReader(r io.Reader) *zstd.Reader {
+	if s.zs == nil {
+		s.zs = zstd.NewReader(r)
+	} else {
+		s.zs.Reset(r)
+	}
+	return s.zs
+}
+
+// grow returns b resized to n bytes, reusing its memory if it is large
+// enough. The contents of the result are undefined.
+func grow(b []byte, n int) []byte {
+	if cap(b) < n {
+		return make([]byte, n)
+	}
+	return b[:n]
+}
+
+// readAll is like io.ReadAll, but reads into the memory of dst, which it
+// replaces once it is full.
+func readAll(dst []byte, r io.Reader) ([]byte, error) {
+	dst = dst[:0]
+	for {
+		if len(dst) == cap(dst) {
+			dst = append(dst, 0)[:len(dst)]
+		}
+		n, err := r.Read(dst[len(dst):cap(dst)])
+		dst = dst[:len(dst)+n]
+		if err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return dst, err
+		}
+	}
+}
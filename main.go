@@ -43,23 +43,34 @@ import (
 	"fmt"
 	"gocog/gocog"
 	"gocog/selfmade"
-	"github.com/airbusgeo/godal"
-	"github.com/airbusgeo/"
 )
 
 func main() {
 
 	fileUrl := "http://localhost:8000/LC08_L1TP_193026_20230806_20230806_02_RT_B1.TIF"
-	cogReader := selfmade.MakeFetchingReader(fileUrl)
+	cogReader, err := selfmade.Open(fileUrl, selfmade.Options{})
+	if err != nil {
+		fmt.Print(err)
+		return
+	}
+	defer cogReader.Close()
 
-	config, _ := gocog.DecodeConfig(cogReader)
+	cog, err := gocog.Open(cogReader)
+	if err != nil {
+		fmt.Print(err)
+		return
+	}
+
+	config, _ := cog.Config(0)
 	fmt.Print(config)
-	geoConfig, _ := gocog.DecodeGeoInfo(cogReader)
+	geoConfig, _ := cog.GeoInfo()
 	fmt.Print(geoConfig)
-	img, _ := gocog.DecodeLevel(cogReader, 3)
+	img, _ := cog.DecodeLevel(3)
 	fmt.Print(img)
 
-	// godal.RegisterVSIHandler("http://", cogReader)
+	// GDAL reads through godal's VSI handlers, which pass a key to Size and
+	// ReadAt; NewVSIReader adapts the reader to them.
+	// godal.RegisterVSIHandler("http://", selfmade.NewVSIReader(cogReader))
 	// file, _ := godal.Open(fileUrl)
 	// fmt.Print(file.Description())
 }
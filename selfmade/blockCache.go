@@ -0,0 +1,139 @@
+package selfmade
+
+import (
+	"container/list"
+	"sync"
+)
+
+// DefaultCacheBytes is the size of the cache a FetchingReader creates when
+// none is given in its Options.
+const DefaultCacheBytes = 64 << 20
+
+// BlockKey identifies one block of a version of a remote file. The version is
+// taken from the ETag or Last-Modified header of the file and may be empty.
+// Length is the block size of the reader, so that readers using different
+// block sizes never mistake each other's blocks for their own.
+type BlockKey struct {
+	Url     string
+	Version string
+	Offset  int64
+	Length  int
+}
+
+// CacheStats is a snapshot of the counters of a BlockCache.
+type CacheStats struct {
+	Hits      int64
+	Misses    int64
+	Evictions int64
+	Blocks    int
+	Bytes     int64
+}
+
+// BlockCache stores the blocks fetched by a FetchingReader. Since blocks are
+// keyed by url, one cache may be shared by several readers of the same file.
+// Implementations must be safe for concurrent use and must not modify the
+// data handed to Add.
+type BlockCache interface {
+	// Get returns the data of the block at key, if present.
+	Get(key BlockKey) ([]byte, bool)
+	// Add stores the data of the block at key.
+	Add(key BlockKey, data []byte)
+	// Invalidate drops all blocks of all versions of url.
+	Invalidate(url string)
+	// Stats returns the current counters of the cache.
+	Stats() CacheStats
+}
+
+// LRUCache is a BlockCache of bounded size. When adding a block would exceed
+// one of its limits, the least recently used blocks are evicted first.
+type LRUCache struct {
+	maxBytes  int64
+	maxBlocks int
+
+	// mu guards all fields below.
+	mu    sync.Mutex
+	ll    *list.List
+	items map[BlockKey]*list.Element
+	stats CacheStats
+}
+
+type lruEntry struct {
+	key  BlockKey
+	data []byte
+}
+
+// NewLRUCache returns a cache holding at most maxBytes bytes in at most
+// maxBlocks blocks. A limit of zero or less means that limit is not enforced.
+func NewLRUCache(maxBytes int64, maxBlocks int) *LRUCache {
+	return &LRUCache{
+		maxBytes:  maxBytes,
+		maxBlocks: maxBlocks,
+		ll:        list.New(),
+		items:     map[BlockKey]*list.Element{},
+	}
+}
+
+func (c *LRUCache) Get(key BlockKey) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[key]
+	if !ok {
+		c.stats.Misses++
+		return nil, false
+	}
+	c.stats.Hits++
+	c.ll.MoveToFront(el)
+	return el.Value.(*lruEntry).data, true
+}
+
+func (c *LRUCache) Add(key BlockKey, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		entry := el.Value.(*lruEntry)
+		c.stats.Bytes += int64(len(data) - len(entry.data))
+		entry.data = data
+		c.ll.MoveToFront(el)
+	} else {
+		c.items[key] = c.ll.PushFront(&lruEntry{key: key, data: data})
+		c.stats.Blocks++
+		c.stats.Bytes += int64(len(data))
+	}
+
+	// Never evict the block just added, even if it alone exceeds the limits.
+	for c.ll.Len() > 1 && c.overLimit() {
+		c.removeElement(c.ll.Back())
+		c.stats.Evictions++
+	}
+}
+
+func (c *LRUCache) Invalidate(url string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, el := range c.items {
+		if key.Url == url {
+			c.removeElement(el)
+		}
+	}
+}
+
+func (c *LRUCache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
+
+func (c *LRUCache) overLimit() bool {
+	return (c.maxBytes > 0 && c.stats.Bytes > c.maxBytes) ||
+		(c.maxBlocks > 0 && c.stats.Blocks > c.maxBlocks)
+}
+
+func (c *LRUCache) removeElement(el *list.Element) {
+	entry := c.ll.Remove(el).(*lruEntry)
+	delete(c.items, entry.key)
+	c.stats.Blocks--
+	c.stats.Bytes -= int64(len(entry.data))
+}
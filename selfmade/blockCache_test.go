@@ -0,0 +1,70 @@
+package selfmade
+
+import "testing"
+
+func TestLRUCacheEviction(t *testing.T) {
+	key := func(off int64) BlockKey { return BlockKey{Url: "a", Offset: off, Length: 4} }
+	c := NewLRUCache(12, 0)
+	c.Add(key(0), make([]byte, 4))
+	c.Add(key(4), make([]byte, 4))
+	c.Add(key(8), make([]byte, 4))
+	c.Get(key(0)) // 4 is the least recently used now
+	c.Add(key(12), make([]byte, 4))
+
+	if _, ok := c.Get(key(4)); ok {
+		t.Error("least recently used block was not evicted")
+	}
+	for _, off := range []int64{0, 8, 12} {
+		if _, ok := c.Get(key(off)); !ok {
+			t.Errorf("block %d was evicted", off)
+		}
+	}
+	want := CacheStats{Hits: 4, Misses: 1, Evictions: 1, Blocks: 3, Bytes: 12}
+	if got := c.Stats(); got != want {
+		t.Errorf("Stats = %+v, want %+v", got, want)
+	}
+}
+
+func TestLRUCacheLimits(t *testing.T) {
+	key := func(url string, off int64) BlockKey { return BlockKey{Url: url, Offset: off, Length: 4} }
+	c := NewLRUCache(0, 2)
+	c.Add(key("a", 0), make([]byte, 4))
+	c.Add(key("a", 4), make([]byte, 4))
+	c.Add(key("b", 0), make([]byte, 4))
+	if got := c.Stats(); got.Blocks != 2 || got.Evictions != 1 {
+		t.Errorf("block limit: Stats = %+v", got)
+	}
+
+	// A block larger than the byte limit is kept until the next one comes.
+	c = NewLRUCache(4, 0)
+	c.Add(key("a", 0), make([]byte, 10))
+	if _, ok := c.Get(key("a", 0)); !ok {
+		t.Error("oversized block was not kept")
+	}
+	c.Add(key("a", 10), make([]byte, 2))
+	if got := c.Stats(); got.Blocks != 1 || got.Bytes != 2 {
+		t.Errorf("byte limit: Stats = %+v", got)
+	}
+
+	// Replacing a block accounts for its new size.
+	c = NewLRUCache(0, 0)
+	c.Add(key("a", 0), make([]byte, 4))
+	c.Add(key("a", 0), make([]byte, 3))
+	if got := c.Stats(); got.Blocks != 1 || got.Bytes != 3 {
+		t.Errorf("replaced block: Stats = %+v", got)
+	}
+}
+
+func TestLRUCacheInvalidate(t *testing.T) {
+	c := NewLRUCache(0, 0)
+	for _, key := range []BlockKey{{Url: "a", Version: "1"}, {Url: "a", Version: "2", Offset: 4}, {Url: "b"}} {
+		c.Add(key, make([]byte, 4))
+	}
+	c.Invalidate("a")
+	if _, ok := c.Get(BlockKey{Url: "b"}); !ok {
+		t.Error("block of another url was dropped")
+	}
+	if got := c.Stats(); got.Blocks != 1 || got.Bytes != 4 {
+		t.Errorf("Stats = %+v, want only the block of b", got)
+	}
+}
@@ -30,17 +30,28 @@ func ReadByteOrder(word []byte) (binary.ByteOrder, error) {
 	return nil, fmt.Errorf("cannot interpret as byte-order: %x ", word[0:2])
 }
 
+const (
+	ClassicTIFF uint16 = 42
+	BigTIFF     uint16 = 43 // 64-bit offsets, for files over 4 GB.
+)
+
 func ReadVersion(word []byte, byteOrder binary.ByteOrder) (uint16, error) {
 	var version = byteOrder.Uint16(word)
-	if version != 42 {
-		return version, fmt.Errorf("unexpected version: %d", word[0:2])
+	if version != ClassicTIFF && version != BigTIFF {
+		return version, fmt.Errorf("unexpected version: %d", version)
 	}
 	return version, nil
 }
 
-func ReadOffsetToFirstIFD(rawData []byte, byteReader binary.ByteOrder) uint32 {
+// ReadOffsetToFirstIFD reads the offset of the first IFD from the header at
+// the start of rawData, which is at byte 4 in classic TIFF files and at byte
+// 8 in BigTIFF ones.
+func ReadOffsetToFirstIFD(rawData []byte, byteReader binary.ByteOrder) uint64 {
+	if byteReader.Uint16(rawData[2:4]) == BigTIFF {
+		return byteReader.Uint64(rawData[8:16])
+	}
 	offsetToFirstIFD := byteReader.Uint32(rawData[4:8])
-	return offsetToFirstIFD
+	return uint64(offsetToFirstIFD)
 }
 
 type TagID uint16
@@ -1114,6 +1125,9 @@ const (
 	SRATIONAL TagDataType = 10 // Two 32-bit signed integers
 	FLOAT     TagDataType = 11 // 4-byte single-precision IEEE floating-point value
 	DOUBLE    TagDataType = 12 // 8-byte double-precision IEEE floating-point value
+	LONG8     TagDataType = 16 // 64-bit unsigned integer, BigTIFF only
+	SLONG8    TagDataType = 17 // 64-bit signed integer, BigTIFF only
+	IFD8      TagDataType = 18 // 64-bit offset to an IFD, BigTIFF only
 )
 
 func (tdt TagDataType) String() string {
@@ -1142,21 +1156,29 @@ func (tdt TagDataType) String() string {
 		return "FLOAT"
 	case DOUBLE:
 		return "DOUBLE"
+	case LONG8:
+		return "LONG8"
+	case SLONG8:
+		return "SLONG8"
+	case IFD8:
+		return "IFD8"
 	}
 	return fmt.Sprintf("unknown(%d)", tdt)
 }
 
 type IFD struct {
-	NrTags          uint16
+	NrTags          uint64
 	TagData         []Tag
-	OffsetToNextIFD uint32
+	OffsetToNextIFD uint64
 }
 
+// Tag is an IFD entry. In BigTIFF files, values of up to 8 bytes are stored in
+// DataOrOffsetToData, otherwise values of up to 4 bytes.
 type Tag struct {
 	TagID              TagID
 	TagDataType        TagDataType
-	NrValues           uint32
-	DataOrOffsetToData uint32
+	NrValues           uint64
+	DataOrOffsetToData uint64
 }
 
 func ReadTag(rawTagData []byte, byteReader binary.ByteOrder) Tag {
@@ -1164,6 +1186,16 @@ func ReadTag(rawTagData []byte, byteReader binary.ByteOrder) Tag {
 	tagDataType := TagDataType(byteReader.Uint16(rawTagData[2:4]))
 	nrValues := byteReader.Uint32(rawTagData[4:8])
 	pointerToTagData := byteReader.Uint32(rawTagData[8:12])
+	tag := Tag{tagId, tagDataType, uint64(nrValues), uint64(pointerToTagData)}
+	return tag
+}
+
+// ReadBigTag reads a BigTIFF IFD entry, which takes 20 bytes.
+func ReadBigTag(rawTagData []byte, byteReader binary.ByteOrder) Tag {
+	tagId := TagID(byteReader.Uint16(rawTagData[:2]))
+	tagDataType := TagDataType(byteReader.Uint16(rawTagData[2:4]))
+	nrValues := byteReader.Uint64(rawTagData[4:12])
+	pointerToTagData := byteReader.Uint64(rawTagData[12:20])
 	tag := Tag{tagId, tagDataType, nrValues, pointerToTagData}
 	return tag
 }
@@ -1182,15 +1214,41 @@ func ReadIFD(rawData []byte, byteReader binary.ByteOrder) IFD {
 
 	offsetToNextIFD := byteReader.Uint32(rawData[currentPosition : currentPosition+4])
 
+	ifd := IFD{uint64(nrTags), tags, uint64(offsetToNextIFD)}
+	return ifd
+}
+
+// ReadBigIFD reads a BigTIFF IFD, which counts its entries and points to the
+// next IFD with 8 bytes.
+func ReadBigIFD(rawData []byte, byteReader binary.ByteOrder) IFD {
+	nrTags := byteReader.Uint64(rawData[:8])
+
+	var currentPosition = 8
+	tags := []Tag{}
+	for i := uint64(0); i < nrTags; i++ {
+		rawTagData := rawData[currentPosition : currentPosition+20]
+		tag := ReadBigTag(rawTagData, byteReader)
+		tags = append(tags, tag)
+		currentPosition += 20
+	}
+
+	offsetToNextIFD := byteReader.Uint64(rawData[currentPosition : currentPosition+8])
+
 	ifd := IFD{nrTags, tags, offsetToNextIFD}
 	return ifd
 }
 
-func ReadIFDs(rawData []byte, offsetToFirstIFD uint32, byteReader binary.ByteOrder) []IFD {
+// ReadIFDs reads all IFDs of the file in rawData, telling classic TIFF and
+// BigTIFF files apart by the header.
+func ReadIFDs(rawData []byte, offsetToFirstIFD uint64, byteReader binary.ByteOrder) []IFD {
+	readIFD := ReadIFD
+	if byteReader.Uint16(rawData[2:4]) == BigTIFF {
+		readIFD = ReadBigIFD
+	}
 	ifds := []IFD{}
 	var currentPosition = offsetToFirstIFD
 	for {
-		ifd := ReadIFD(rawData[currentPosition:], byteReader)
+		ifd := readIFD(rawData[currentPosition:], byteReader)
 		ifds = append(ifds, ifd)
 		if ifd.OffsetToNextIFD == 0 {
 			break
@@ -0,0 +1,123 @@
+package selfmade
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"gocog/gocog"
+)
+
+// tagValues returns the values of tag, an entry of an IFD of the file in data,
+// as unsigned integers. Values that fit into the entry are stored in it,
+// left-aligned, otherwise the entry points to them.
+func tagValues(data []byte, bo binary.ByteOrder, big bool, tag Tag) []uint64 {
+	var size int
+	switch tag.TagDataType {
+	case SHORT:
+		size = 2
+	case LONG:
+		size = 4
+	case LONG8:
+		size = 8
+	default:
+		return nil
+	}
+	n := int(tag.NrValues)
+	var raw []byte
+	if big && n*size <= 8 {
+		raw = make([]byte, 8)
+		bo.PutUint64(raw, tag.DataOrOffsetToData)
+	} else if !big && n*size <= 4 {
+		raw = make([]byte, 4)
+		bo.PutUint32(raw, uint32(tag.DataOrOffsetToData))
+	} else {
+		raw = data[tag.DataOrOffsetToData:]
+	}
+	values := make([]uint64, n)
+	for i := range values {
+		switch size {
+		case 2:
+			values[i] = uint64(bo.Uint16(raw[2*i:]))
+		case 4:
+			values[i] = uint64(bo.Uint32(raw[4*i:]))
+		case 8:
+			values[i] = bo.Uint64(raw[8*i:])
+		}
+	}
+	return values
+}
+
+func TestReadIFDsAsGocog(t *testing.T) {
+	for _, name := range []string{"uint16_none", "uint16_strips", "uint16_bigtiff", "uint16_bigtiff_be", "int16_bigtiff_be_deflate"} {
+		t.Run(name, func(t *testing.T) {
+			data, err := os.ReadFile(filepath.Join("..", "gocog", "testdata", name+".tif"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			c, err := gocog.Open(bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			bo, err := ReadByteOrder(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			version, err := ReadVersion(data[2:4], bo)
+			if err != nil {
+				t.Fatal(err)
+			}
+			big := version == BigTIFF
+			ifds := ReadIFDs(data, ReadOffsetToFirstIFD(data, bo), bo)
+			if len(ifds) != c.Levels() {
+				t.Fatalf("read %d IFDs, gocog %d", len(ifds), c.Levels())
+			}
+
+			for level, ifd := range ifds {
+				cfg, _ := c.Level(level)
+				offsets, counts := cfg.TileOffsets, cfg.TileByteCounts
+				want := map[TagID][]uint64{
+					ImageWidth:      {uint64(cfg.ImageWidth)},
+					ImageLength:     {uint64(cfg.ImageHeight)},
+					Compression:     {uint64(cfg.Compression)},
+					SamplesPerPixel: {uint64(cfg.SamplesPerPixel)},
+					BitsPerSample:   nil,
+					SampleFormat:    nil,
+				}
+				for _, bps := range cfg.BitsPerSample {
+					want[BitsPerSample] = append(want[BitsPerSample], uint64(bps))
+				}
+				for _, format := range cfg.SampleFormat {
+					want[SampleFormat] = append(want[SampleFormat], uint64(format))
+				}
+				if cfg.Stripped {
+					want[StripOffsets], want[StripByteCounts] = offsets, counts
+				} else {
+					want[TileWidth], want[TileLength] = []uint64{uint64(cfg.TileWidth)}, []uint64{uint64(cfg.TileHeight)}
+					want[TileOffsets], want[TileByteCounts] = offsets, counts
+				}
+
+				// BitsPerSample and SampleFormat of three bands are stored in
+				// the entries of BigTIFF files, which hold 8 bytes.
+				found := 0
+				for _, tag := range ifd.TagData {
+					w, ok := want[tag.TagID]
+					if !ok {
+						continue
+					}
+					found++
+					if got := tagValues(data, bo, big, tag); !reflect.DeepEqual(got, w) {
+						t.Errorf("IFD %d: %v = %v, gocog read %v", level, tag.TagID, got, w)
+					}
+				}
+				if found != len(want) {
+					t.Errorf("IFD %d holds %d of the %d tags gocog read", level, found, len(want))
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,332 @@
+package selfmade
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DiskCache is a BlockCache keeping blocks in files below a directory, so
+// that they survive restarts. Blocks are stored per url and version; blocks
+// without a version are not stored, as there would be no telling whether
+// they are still current. Consecutive blocks added together, as a reader
+// fetches them, share a file, and files never span more than one segment of
+// diskSegmentBytes of the remote file. When the files take more than
+// maxBytes, the least recently used ones are removed.
+type DiskCache struct {
+	dir      string
+	maxBytes int64
+
+	// mu guards stats.
+	mu    sync.Mutex
+	stats CacheStats
+}
+
+// diskSegmentBytes is the part of a remote file whose blocks are kept in one
+// directory, which Get lists to find the file holding a block.
+const diskSegmentBytes = 1 << 20
+
+// NewDiskCache returns a cache storing at most maxBytes bytes below dir,
+// which is created if needed. Blocks already in dir are used. A maxBytes of
+// zero or less means the size is not limited.
+func NewDiskCache(dir string, maxBytes int64) (*DiskCache, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	c := &DiskCache{dir: dir, maxBytes: maxBytes}
+	if err := c.Cleanup(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func hashHex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:16])
+}
+
+func (c *DiskCache) urlDir(url string) string {
+	return filepath.Join(c.dir, hashHex(url))
+}
+
+// segmentDir returns the directory of the files holding blocks of the same
+// url, version and length as key that start in the segment at offset.
+func (c *DiskCache) segmentDir(key BlockKey, offset int64) string {
+	return filepath.Join(c.urlDir(key.Url),
+		hashHex(key.Version)+"-"+strconv.Itoa(key.Length)+"-"+strconv.FormatInt(offset/diskSegmentBytes, 10))
+}
+
+// parseRunName returns the offset in the remote file and the length of the
+// blocks a file of name holds, which is of the form "offset-length".
+func parseRunName(name string) (offset, n int64, ok bool) {
+	first, last, found := strings.Cut(name, "-")
+	if !found {
+		return 0, 0, false
+	}
+	offset, err1 := strconv.ParseInt(first, 10, 64)
+	n, err2 := strconv.ParseInt(last, 10, 64)
+	return offset, n, err1 == nil && err2 == nil && offset >= 0 && n > 0
+}
+
+func (c *DiskCache) Get(key BlockKey) ([]byte, bool) {
+	if key.Version == "" {
+		c.count(false)
+		return nil, false
+	}
+	dir := c.segmentDir(key, key.Offset)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		c.count(false)
+		return nil, false
+	}
+	for _, entry := range entries {
+		offset, n, ok := parseRunName(entry.Name())
+		if !ok || key.Offset < offset || key.Offset >= offset+n || (key.Offset-offset)%int64(key.Length) != 0 {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		data, err := readFileAt(path, key.Offset-offset, minInt(key.Length, int(offset+n-key.Offset)))
+		if err != nil {
+			continue
+		}
+		// The modification time tells Cleanup which files were used last.
+		now := time.Now()
+		os.Chtimes(path, now, now)
+		c.count(true)
+		return data, true
+	}
+	c.count(false)
+	return nil, false
+}
+
+// readFileAt reads the n bytes at off of the file at path.
+func readFileAt(path string, off int64, n int) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	data := make([]byte, n)
+	if _, err := f.ReadAt(data, off); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (c *DiskCache) count(hit bool) {
+	c.mu.Lock()
+	if hit {
+		c.stats.Hits++
+	} else {
+		c.stats.Misses++
+	}
+	c.mu.Unlock()
+}
+
+func (c *DiskCache) Add(key BlockKey, data []byte) {
+	c.addRun(key, data)
+}
+
+// addRun stores data, which holds the consecutive blocks starting with the
+// one at key, in one file for each segment they start in.
+func (c *DiskCache) addRun(key BlockKey, data []byte) {
+	if key.Version == "" || key.Length <= 0 {
+		return
+	}
+	for len(data) > 0 {
+		segment := key.Offset / diskSegmentBytes
+		n := 0
+		for n < len(data) && (key.Offset+int64(n))/diskSegmentBytes == segment {
+			n += key.Length
+		}
+		n = minInt(n, len(data))
+		c.write(key, data[:n])
+		key.Offset += int64(n)
+		data = data[n:]
+	}
+}
+
+// write stores data, the blocks starting with the one at key, in one file.
+func (c *DiskCache) write(key BlockKey, data []byte) {
+	dir := c.segmentDir(key, key.Offset)
+	path := filepath.Join(dir, strconv.FormatInt(key.Offset, 10)+"-"+strconv.Itoa(len(data)))
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return
+	}
+	// Write to a temporary file first, so that no reader, in this process or
+	// another, ever sees half a file.
+	tmp, err := os.CreateTemp(dir, ".tmp-*")
+	if err != nil {
+		return
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	var old int64 = -1
+	if info, statErr := os.Stat(path); statErr == nil {
+		old = info.Size()
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return
+	}
+
+	c.mu.Lock()
+	if old >= 0 {
+		c.stats.Bytes -= old
+		c.stats.Blocks -= blockCount(old, key.Length)
+	}
+	c.stats.Bytes += int64(len(data))
+	c.stats.Blocks += blockCount(int64(len(data)), key.Length)
+	over := c.maxBytes > 0 && c.stats.Bytes > c.maxBytes
+	c.mu.Unlock()
+
+	if over {
+		c.Cleanup()
+	}
+}
+
+// blockCount returns how many blocks of length a file of size bytes holds.
+func blockCount(size int64, length int) int {
+	return int((size + int64(length) - 1) / int64(length))
+}
+
+func (c *DiskCache) Invalidate(url string) {
+	os.RemoveAll(c.urlDir(url))
+	c.Cleanup()
+}
+
+func (c *DiskCache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
+
+// Cleanup recounts the blocks on disk and, if they exceed the size limit,
+// removes the least recently used files until they take at most nine tenths
+// of it, so that not every following Add has to clean up again. Leftovers of
+// interrupted writes are removed as well.
+func (c *DiskCache) Cleanup() error {
+	type runFile struct {
+		path    string
+		size    int64
+		blocks  int
+		modTime time.Time
+	}
+	var files []runFile
+	var total int64
+	blocks := 0
+	err := filepath.WalkDir(c.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// Another process may have removed the file in the meantime.
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		_, _, isRun := parseRunName(d.Name())
+		// The name of a segment directory has the block length in between
+		// the version and the segment.
+		_, segment, _ := strings.Cut(filepath.Base(filepath.Dir(path)), "-")
+		length, _, _ := strings.Cut(segment, "-")
+		blockLength, err := strconv.Atoi(length)
+		if !isRun || err != nil || blockLength <= 0 {
+			if time.Since(info.ModTime()) > time.Hour {
+				os.Remove(path)
+			}
+			return nil
+		}
+		n := blockCount(info.Size(), blockLength)
+		files = append(files, runFile{path, info.Size(), n, info.ModTime()})
+		total += info.Size()
+		blocks += n
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var evicted int64
+	if c.maxBytes > 0 && total > c.maxBytes {
+		target := c.maxBytes - c.maxBytes/10
+		sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+		for len(files) > 0 && total > target {
+			if err := os.Remove(files[0].path); err == nil || os.IsNotExist(err) {
+				total -= files[0].size
+				blocks -= files[0].blocks
+				evicted += int64(files[0].blocks)
+				// Drop the segment directory once it is empty.
+				os.Remove(filepath.Dir(files[0].path))
+			}
+			files = files[1:]
+		}
+	}
+
+	c.mu.Lock()
+	c.stats.Blocks = blocks
+	c.stats.Bytes = total
+	c.stats.Evictions += evicted
+	c.mu.Unlock()
+	return nil
+}
+
+// tieredCache puts a fast cache in front of a slower one. Blocks found only
+// in the back are copied to the front.
+type tieredCache struct {
+	front BlockCache
+	back  BlockCache
+}
+
+// NewTieredCache returns a BlockCache looking up blocks in front first and in
+// back second, and adding blocks to both. Its Stats count a hit in either
+// cache as a hit, and report the size of front.
+func NewTieredCache(front, back BlockCache) BlockCache {
+	return &tieredCache{front: front, back: back}
+}
+
+func (c *tieredCache) Get(key BlockKey) ([]byte, bool) {
+	if data, ok := c.front.Get(key); ok {
+		return data, true
+	}
+	data, ok := c.back.Get(key)
+	if ok {
+		c.front.Add(key, data)
+	}
+	return data, ok
+}
+
+func (c *tieredCache) Add(key BlockKey, data []byte) {
+	c.front.Add(key, data)
+	c.back.Add(key, data)
+}
+
+func (c *tieredCache) Invalidate(url string) {
+	c.front.Invalidate(url)
+	c.back.Invalidate(url)
+}
+
+func (c *tieredCache) Stats() CacheStats {
+	stats := c.front.Stats()
+	back := c.back.Stats()
+	stats.Hits += back.Hits
+	stats.Misses = back.Misses
+	return stats
+}
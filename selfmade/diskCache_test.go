@@ -0,0 +1,119 @@
+package selfmade
+
+import (
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestDiskCacheRestart(t *testing.T) {
+	data := testData(3 << 20)
+	store := newStubStore(t)
+	store.put("/a.tif", data)
+	dir := t.TempDir()
+	off := int64(1<<20 - 100000) // reads across two segments
+
+	dc, err := NewDiskCache(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := MakeFetchingReaderWithOptions(store.url("/a.tif"), Options{DiskCache: dc})
+	checkRead(t, r, data, off, 300000)
+	bufs := [][]byte{make([]byte, 10), make([]byte, 5)}
+	if _, err := r.ReadAtMulti("", bufs, []int64{2 << 20, 3<<20 - 5}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Runs of blocks are stored together, split where segments end.
+	var files []string
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if len(files) != 4 {
+		t.Errorf("cache holds files %q, want 4: the two halves of the read across segments and one per range", files)
+	}
+
+	// After a restart, the blocks are read from disk once the version of the
+	// file is known, which takes a single HEAD request.
+	store.reset()
+	dc, err = NewDiskCache(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := dc.Stats(); got.Blocks == 0 || got.Bytes == 0 {
+		t.Errorf("restarted cache is empty: %+v", got)
+	}
+	r = MakeFetchingReaderWithOptions(store.url("/a.tif"), Options{DiskCache: dc})
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			checkRead(t, r, data, off, 300000)
+			checkRead(t, r, data, 3<<20-5, 5)
+		}()
+	}
+	wg.Wait()
+	if log := store.log(); len(log) != 1 || log[0].Method != http.MethodHead {
+		t.Errorf("sent %+v, want one HEAD request", log)
+	}
+	if got := r.Stats(); got.CacheMisses != 0 {
+		t.Errorf("Stats = %+v, want no cache misses", got)
+	}
+
+	// Another version of the file does not use the blocks of the old one.
+	store.put("/a.tif", append([]byte{1}, data[1:]...))
+	store.reset()
+	dc, _ = NewDiskCache(dir, 0)
+	r = MakeFetchingReaderWithOptions(store.url("/a.tif"), Options{DiskCache: dc, HeaderBytes: -1})
+	checkRead(t, r, data, off, 100)
+	if n := store.count(); n != 2 {
+		t.Errorf("sent %d requests for a new version, want a HEAD and a GET", n)
+	}
+}
+
+func TestDiskCacheLimit(t *testing.T) {
+	data := testData(100000)
+	store := newStubStore(t)
+	store.put("/a.tif", data)
+	dc, err := NewDiskCache(t.TempDir(), 30000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := MakeFetchingReaderWithOptions(store.url("/a.tif"), Options{DiskCache: dc, HeaderBytes: -1})
+
+	for off := int64(0); off < 100000; off += 20000 {
+		checkRead(t, r, data, off, 10000)
+	}
+	if got := dc.Stats(); got.Bytes > 30000 || got.Evictions == 0 {
+		t.Errorf("Stats = %+v, want at most 30000 bytes after evictions", got)
+	}
+
+	r.Invalidate()
+	if got := dc.Stats(); got.Blocks != 0 || got.Bytes != 0 {
+		t.Errorf("Stats after Invalidate = %+v, want an empty cache", got)
+	}
+}
+
+func TestDiskCacheWithoutVersion(t *testing.T) {
+	data := testData(10000)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveData(w, r, data) // without ETag or Last-Modified
+	}))
+	defer srv.Close()
+	dc, err := NewDiskCache(t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := MakeFetchingReaderWithOptions(srv.URL, Options{DiskCache: dc, HeaderBytes: -1})
+	checkRead(t, r, data, 0, 100)
+	if got := dc.Stats(); got.Blocks != 0 {
+		t.Errorf("stored %d blocks of unknown version", got.Blocks)
+	}
+}
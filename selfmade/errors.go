@@ -0,0 +1,83 @@
+package selfmade
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ErrRangeIgnored is returned when a server answers a range request with the
+// whole file (status 200) instead of the requested bytes.
+var ErrRangeIgnored = errors.New("server ignored the range request")
+
+// ErrObjectChanged is returned when the remote file is no longer the version
+// that was read before, as told by its ETag or Last-Modified header.
+var ErrObjectChanged = errors.New("remote object changed")
+
+// ErrNoContentLength is returned when the size of a file cannot be determined
+// because the server does not send a Content-Length.
+var ErrNoContentLength = errors.New("server did not send a Content-Length")
+
+// RangeNotSatisfiableError reports a 416 answer to a range request, which
+// servers send when the range starts at or beyond the end of the file.
+type RangeNotSatisfiableError struct {
+	Range string
+	Size  int64 // size of the file as reported by the server, or -1
+}
+
+func (e *RangeNotSatisfiableError) Error() string {
+	return fmt.Sprintf("range %s not satisfiable (file size %d)", e.Range, e.Size)
+}
+
+// ShortReadError reports a response that holds fewer bytes than were asked
+// for or announced, without the end of the file explaining the difference.
+type ShortReadError struct {
+	Want int64
+	Got  int64
+}
+
+func (e *ShortReadError) Error() string {
+	return fmt.Sprintf("short read: wanted %d bytes, got %d", e.Want, e.Got)
+}
+
+// StatusError reports an unexpected http status.
+type StatusError struct {
+	Code   int
+	Status string
+	// RetryAfter is how long the server asked to wait before trying again,
+	// in the Retry-After header of a 429 or 503 answer, or zero.
+	RetryAfter time.Duration
+}
+
+// statusError returns the StatusError for res.
+func statusError(res *http.Response) *StatusError {
+	err := &StatusError{Code: res.StatusCode, Status: res.Status}
+	if res.StatusCode == http.StatusTooManyRequests || res.StatusCode == http.StatusServiceUnavailable {
+		err.RetryAfter = parseRetryAfter(res.Header.Get("Retry-After"), time.Now())
+	}
+	return err
+}
+
+// parseRetryAfter returns the wait a Retry-After header asks for at time
+// now. The header holds either a number of seconds or an http date.
+func parseRetryAfter(header string, now time.Time) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(header); err == nil {
+		if secs < 0 {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(header); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
+
+func (e *StatusError) Error() string {
+	return "unexpected http status: " + e.Status
+}
@@ -1,63 +1,238 @@
 package selfmade
 
 import (
+	"bytes"
+	"context"
 	"errors"
-	"fmt"
 	"io"
 	"net/http"
-	"strconv"
+	"sort"
+	"sync"
+	"time"
 )
 
-func fetchSize(fileUrl string) (int, error) {
-	fmt.Printf("Getting size of %s", fileUrl)
-	req, err := http.NewRequest(http.MethodHead, fileUrl, nil)
-	if err != nil {
-		return 0, err
-	}
+// Logger receives the debug output of a FetchingReader. *log.Logger
+// implements it.
+type Logger interface {
+	Printf(format string, v ...any)
+}
 
-	res, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return 0, err
-	}
+// Options configures a FetchingReader. The zero value is usable.
+type Options struct {
+	// Cache holds the fetched blocks. If nil, a new LRUCache of
+	// DefaultCacheBytes is used.
+	Cache BlockCache
+	// DiskCache, if set, keeps the fetched blocks on disk as well, behind
+	// Cache. Blocks found there are used across restarts as long as the
+	// file keeps its ETag or Last-Modified, which the reader asks for with
+	// a HEAD request before its first read.
+	DiskCache *DiskCache
+
+	// BlockSize is the size of the blocks the file is fetched and cached
+	// in. If zero, DefaultBlockSize is used.
+	BlockSize int
+	// HeaderBytes is how much of the start of the file is fetched at once by
+	// the first read there, which for a cloud optimized GeoTIFF covers the
+	// header and all IFDs. If zero, DefaultHeaderBytes is used; a negative
+	// value disables the prefetch.
+	HeaderBytes int
+	// MaxReadahead, if positive, makes sequential reads fetch blocks beyond
+	// the ones asked for: one block at first and twice as many with every
+	// further sequential read, up to MaxReadahead bytes.
+	MaxReadahead int
+
+	// Client sends the requests. If nil, http.DefaultClient is used.
+	Client *http.Client
+	// Header is added to every request.
+	Header http.Header
+	// UserAgent, if set, replaces the default User-Agent header.
+	UserAgent string
+	// Username and Password are sent using basic authentication if
+	// Username is set.
+	Username string
+	Password string
+	// BearerToken, if set, is sent as "Authorization: Bearer <token>".
+	BearerToken string
+	// PrepareRequest, if set, is called with every request right before it
+	// is sent, e.g. to sign it. Returning an error aborts the request.
+	PrepareRequest func(req *http.Request) error
+	// Retry says how failed requests are retried. If nil,
+	// DefaultRetryPolicy is used.
+	Retry *RetryPolicy
 
-	contentLength := res.Header.Get("Content-Length")
-	clInt, err := strconv.Atoi(contentLength)
+	// InvalidateOnChange makes the reader drop its cached blocks when it
+	// finds that the file has changed, so that reads after the one failing
+	// with ErrObjectChanged see the new version.
+	InvalidateOnChange bool
 
-	return clInt, nil
+	// Logger, if set, is told about every request made.
+	Logger Logger
+	// Observer, if set, is called after every request sent to the source,
+	// see Stats, e.g. to feed the numbers into a metrics system. It must not
+	// block for long.
+	Observer func(RequestEvent)
 }
 
-func fetchRange(fileUrl string, startByte int64, nrBytes int) ([]byte, error) {
-	fmt.Printf("Fetching bytes %d-%d", startByte, startByte+int64(nrBytes))
-	req, err := http.NewRequest(http.MethodGet, fileUrl, nil)
-	if err != nil {
-		return nil, err
+// DefaultBlockSize is the block size of a FetchingReader whose Options do not
+// set one.
+const DefaultBlockSize = 4000
+
+// DefaultHeaderBytes is how much of the start of a file a FetchingReader
+// prefetches unless its Options say otherwise.
+const DefaultHeaderBytes = 64 << 10
+
+// FetchingReader reads a file from a RangeSource, by default a remote file
+// through http range requests, fetching it in blocks of fetchBytes and keeping
+// the fetched blocks in a BlockCache. It is safe for concurrent use.
+type FetchingReader struct {
+	fileUrl            string
+	source             RangeSource
+	fetchBytes         int
+	headerBytes        int
+	maxReadahead       int
+	cache              BlockCache
+	disk               *DiskCache // nil unless blocks are cached across restarts
+	invalidateOnChange bool
+	observer           func(RequestEvent)
+
+	// mu guards all fields below.
+	mu              sync.Mutex
+	currentLocation int64
+	versionKnown    bool
+	versionFetch    *blockFetch // the HEAD request of resolveVersion in progress
+	headerFetched   bool
+	lastKey         int64 // last block of the previous read
+	readahead       int   // blocks to read ahead if the next read is sequential
+	inFlight        map[int64]*blockFetch
+	stats           Stats
+}
+
+// blockFetch is a request for a single block that is still in progress.
+// Goroutines needing the same block wait for done to be closed instead of
+// issuing a request of their own.
+type blockFetch struct {
+	done chan struct{}
+	data []byte
+	err  error
+}
+
+func MakeFetchingReader(fileUrl string) *FetchingReader {
+	return MakeFetchingReaderWithOptions(fileUrl, Options{})
+}
+
+func MakeFetchingReaderWithOptions(fileUrl string, opts Options) *FetchingReader {
+	return MakeFetchingReaderFromSource(fileUrl, NewHTTPSource(fileUrl, opts), opts)
+}
+
+// MakeFetchingReaderFromSource returns a reader of source, whose blocks are
+// cached under fileUrl. Of opts, the fields about requests are ignored; they
+// are up to source.
+func MakeFetchingReaderFromSource(fileUrl string, source RangeSource, opts Options) *FetchingReader {
+	cache := opts.Cache
+	if cache == nil {
+		cache = NewLRUCache(DefaultCacheBytes, 0)
+	}
+	fetchBytes := opts.BlockSize
+	if fetchBytes <= 0 {
+		fetchBytes = DefaultBlockSize
 	}
-	req.Header.Add("Range", fmt.Sprintf("bytes=%d-%d", startByte, startByte+int64(nrBytes)))
+	headerBytes := opts.HeaderBytes
+	if headerBytes == 0 {
+		headerBytes = DefaultHeaderBytes
+	}
+	return &FetchingReader{
+		fileUrl: fileUrl, source: source, fetchBytes: fetchBytes, cache: cache, disk: opts.DiskCache,
+		headerBytes: headerBytes, maxReadahead: opts.MaxReadahead,
+		invalidateOnChange: opts.InvalidateOnChange, observer: opts.Observer,
+		currentLocation: 0, lastKey: -1, inFlight: map[int64]*blockFetch{},
+	}
+}
 
-	res, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return nil, err
+// Invalidate drops all cached blocks of the file and forgets its version, so
+// that the next read starts over with whatever version the source has.
+func (r *FetchingReader) Invalidate() {
+	if forgetter, ok := r.source.(VersionForgetter); ok {
+		forgetter.ForgetVersion()
+	}
+	r.cache.Invalidate(r.fileUrl)
+	if r.disk != nil {
+		r.disk.Invalidate(r.fileUrl)
 	}
+	r.mu.Lock()
+	r.versionKnown = false
+	r.headerFetched = false
+	r.mu.Unlock()
+}
 
-	data, err2 := io.ReadAll(res.Body)
-	if err2 != nil {
-		return nil, err2
+// resolveVersion learns the version of the file before the first block is
+// looked up, so that blocks cached on disk by an earlier run are found.
+// Concurrent first reads share a single request.
+func (r *FetchingReader) resolveVersion(ctx context.Context) error {
+	if r.disk == nil {
+		return nil
 	}
+	for {
+		r.mu.Lock()
+		if r.versionKnown || r.source.Version() != "" {
+			r.mu.Unlock()
+			return nil
+		}
+		f := r.versionFetch
+		if f == nil {
+			f = &blockFetch{done: make(chan struct{})}
+			r.versionFetch = f
+			r.mu.Unlock()
+			f.err = r.fetchVersion(ctx)
+			r.mu.Lock()
+			r.versionFetch = nil
+			r.mu.Unlock()
+			close(f.done)
+			return f.err
+		}
+		r.mu.Unlock()
 
-	return data, nil
+		select {
+		case <-f.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if f.err != nil && ctx.Err() == nil &&
+			(errors.Is(f.err, context.Canceled) || errors.Is(f.err, context.DeadlineExceeded)) {
+			// The request was made for a goroutine whose context ended before
+			// ours; try again.
+			continue
+		}
+		return f.err
+	}
 }
 
-type FetchingReader struct {
-	fileUrl         string
-	fetchBytes      int
-	currentLocation int64
-	fetchedData     map[int64][]byte
+// fetchVersion asks the source for the size of the file, which makes it learn
+// the version as well.
+func (r *FetchingReader) fetchVersion(ctx context.Context) error {
+	ctx, _ = r.observe(ctx, nil)
+	if _, err := r.source.Size(ctx); err != nil {
+		if r.invalidateOnChange && errors.Is(err, ErrObjectChanged) {
+			r.Invalidate()
+		}
+		return err
+	}
+	r.mu.Lock()
+	r.versionKnown = true
+	r.mu.Unlock()
+	return nil
 }
 
-func MakeFetchingReader(fileUrl string) *FetchingReader {
-	return &FetchingReader{
-		fileUrl: fileUrl, fetchBytes: 4000, currentLocation: 0, fetchedData: map[int64][]byte{},
+// CacheStats returns the counters of the cache used by r. With a DiskCache,
+// they are those of both caches together, as a tiered cache reports them.
+func (r *FetchingReader) CacheStats() CacheStats {
+	if r.disk != nil {
+		return NewTieredCache(r.cache, r.disk).Stats()
 	}
+	return r.cache.Stats()
+}
+
+func (r *FetchingReader) blockKey(version string, offset int64) BlockKey {
+	return BlockKey{Url: r.fileUrl, Version: version, Offset: offset, Length: r.fetchBytes}
 }
 
 func (r *FetchingReader) getKeysFor(start int64, length int) []int64 {
@@ -69,30 +244,312 @@ func (r *FetchingReader) getKeysFor(start int64, length int) []int64 {
 	return keys
 }
 
-func (r *FetchingReader) getDataForKey(key int64) ([]byte, error) {
-	data, ok := r.fetchedData[key]
-	if !ok {
-		data, err := fetchRange(r.fileUrl, key, r.fetchBytes)
+// getDataForKeys returns the data of the blocks at keys, which must be
+// sorted. Blocks that are neither cached nor already being fetched by another
+// goroutine are fetched here, with one range per run of consecutive missing
+// blocks and all ranges in a single request. Such a request also fetches the
+// blocks suggested by withPrefetch. want holds the [start, length] spans of
+// the file the caller actually needs, which tells the statistics how much of
+// a request was over-fetched.
+func (r *FetchingReader) getDataForKeys(ctx context.Context, keys []int64, want [][2]int64) ([][]byte, error) {
+	if err := r.resolveVersion(ctx); err != nil {
+		return nil, err
+	}
+	all, optional, header := r.withPrefetch(keys)
+	for {
+		blocks, fetched, err := r.tryGetDataForKeys(ctx, all, optional, want)
+		if err != nil && ctx.Err() == nil &&
+			(errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)) {
+			// A block was being fetched by a goroutine whose context ended
+			// before ours; try again.
+			continue
+		}
 		if err != nil {
-			return data, err
+			return nil, err
+		}
+		if header && fetched {
+			r.mu.Lock()
+			r.headerFetched = true
+			r.mu.Unlock()
+		}
+		return pickBlocks(all, blocks, keys), nil
+	}
+}
+
+// withPrefetch adds to keys the blocks worth fetching along with them: the
+// whole header on the first read touching it, and the readahead if the read
+// continues the one before. The blocks added are marked optional. It reports
+// whether the header was added.
+func (r *FetchingReader) withPrefetch(keys []int64) ([]int64, []bool, bool) {
+	if len(keys) == 0 {
+		return keys, nil, false
+	}
+	first, last := keys[0], keys[len(keys)-1]
+	block := int64(r.fetchBytes)
+
+	r.mu.Lock()
+	header := r.headerBytes > 0 && !r.headerFetched && first < int64(r.headerBytes)
+	ahead := 0
+	if r.maxReadahead > 0 {
+		if r.lastKey >= 0 && (first == r.lastKey || first == r.lastKey+block) {
+			ahead = r.readahead
+			r.readahead = minInt(2*r.readahead, maxInt(r.maxReadahead/r.fetchBytes, 1))
+		} else {
+			r.readahead = 1
+		}
+		r.lastKey = last
+	}
+	r.mu.Unlock()
+
+	var extra []int64
+	if header {
+		extra = r.getKeysFor(0, r.headerBytes)
+	}
+	for i := 1; i <= ahead; i++ {
+		extra = append(extra, last+int64(i)*block)
+	}
+	if len(extra) == 0 {
+		return keys, nil, false
+	}
+
+	all := make([]int64, 0, len(keys)+len(extra))
+	optional := make([]bool, 0, len(keys)+len(extra))
+	sort.Slice(extra, func(i, j int) bool { return extra[i] < extra[j] })
+	for len(keys) > 0 || len(extra) > 0 {
+		switch {
+		case len(extra) == 0 || (len(keys) > 0 && keys[0] < extra[0]):
+			all, optional, keys = append(all, keys[0]), append(optional, false), keys[1:]
+		case len(keys) == 0 || extra[0] < keys[0]:
+			all, optional, extra = append(all, extra[0]), append(optional, true), extra[1:]
+		default:
+			all, optional, keys, extra = append(all, keys[0]), append(optional, false), keys[1:], extra[1:]
+		}
+	}
+	return all, optional, header
+}
+
+// pickBlocks returns the blocks at keys out of the blocks at all, where keys
+// is a subset of all and both are sorted.
+func pickBlocks(all []int64, blocks [][]byte, keys []int64) [][]byte {
+	if len(all) == len(keys) {
+		return blocks
+	}
+	picked := make([][]byte, 0, len(keys))
+	j := 0
+	for _, key := range keys {
+		for all[j] != key {
+			j++
 		}
-		r.fetchedData[key] = data
-		return data, nil
+		picked = append(picked, blocks[j])
 	}
-	return data, nil
+	return picked
 }
 
-func (r *FetchingReader) getDataAt(off int64, nrBytes int) ([]byte, error) {
+// tryGetDataForKeys returns the blocks at keys. Blocks marked optional are
+// only fetched along with others that are missing, and are nil in the result
+// unless cached. It reports whether it fetched the optional blocks.
+//
+// The DiskCache, if any, is only used without holding r.mu, so that reads
+// finding their blocks in memory never wait for the disk. Blocks looked up
+// there are marked as in flight before, so that no other goroutine fetches
+// them meanwhile.
+func (r *FetchingReader) tryGetDataForKeys(ctx context.Context, keys []int64, optional []bool, want [][2]int64) ([][]byte, bool, error) {
+	blocks := make([][]byte, len(keys))
+	fetches := make([]*blockFetch, len(keys))
+	var missing []int // indices into keys of the blocks nobody fetches yet
+	needed := false   // whether a block that is not optional is missing
+
+	version := r.source.Version()
+
+	r.mu.Lock()
+	for i, key := range keys {
+		isOptional := optional != nil && optional[i]
+		data, ok := r.cache.Get(r.blockKey(version, key))
+		if ok {
+			if !isOptional {
+				r.stats.CacheHits++
+			}
+			blocks[i] = data
+			continue
+		}
+		if f, ok := r.inFlight[key]; ok {
+			if !isOptional {
+				r.stats.CacheMisses++
+				fetches[i] = f
+			}
+			continue
+		}
+		missing = append(missing, i)
+		needed = needed || !isOptional
+	}
+	if needed {
+		for _, i := range missing {
+			f := &blockFetch{done: make(chan struct{})}
+			r.inFlight[keys[i]] = f
+			fetches[i] = f
+		}
+	} else {
+		missing = nil
+	}
+	r.mu.Unlock()
+
+	missing = r.getFromDisk(version, keys, optional, fetches, missing)
+	var runs [][2]int // [start, end) indices into keys of the runs to fetch here
+	for _, i := range missing {
+		if n := len(runs); n > 0 && runs[n-1][1] == i && keys[i-1]+int64(r.fetchBytes) == keys[i] {
+			runs[n-1][1]++
+		} else {
+			runs = append(runs, [2]int{i, i + 1})
+		}
+	}
+	if len(runs) > 0 {
+		r.fetchRuns(ctx, keys, fetches, runs, want)
+	}
+
+	for i, f := range fetches {
+		if f == nil {
+			continue
+		}
+		select {
+		case <-f.done:
+		case <-ctx.Done():
+			return nil, false, ctx.Err()
+		}
+		if f.err != nil {
+			return nil, false, f.err
+		}
+		blocks[i] = f.data
+	}
+	return blocks, needed, nil
+}
+
+// getFromDisk looks up the blocks at the indices missing into keys in the
+// DiskCache, if any, and completes the fetches of those it finds. It returns
+// the indices of the blocks still missing, which are counted as cache misses
+// unless optional.
+func (r *FetchingReader) getFromDisk(version string, keys []int64, optional []bool, fetches []*blockFetch, missing []int) []int {
+	if len(missing) == 0 {
+		return nil
+	}
+	var found []int
+	if r.disk != nil {
+		for _, i := range missing {
+			if data, ok := r.disk.Get(r.blockKey(version, keys[i])); ok {
+				fetches[i].data = data
+				found = append(found, i)
+			}
+		}
+	}
+
+	r.mu.Lock()
+	still := missing[:0]
+	k := 0
+	for _, i := range missing {
+		isOptional := optional != nil && optional[i]
+		if k < len(found) && found[k] == i {
+			k++
+			r.cache.Add(r.blockKey(version, keys[i]), fetches[i].data)
+			delete(r.inFlight, keys[i])
+			if !isOptional {
+				r.stats.CacheHits++
+			}
+			continue
+		}
+		if !isOptional {
+			r.stats.CacheMisses++
+		}
+		still = append(still, i)
+	}
+	r.mu.Unlock()
+
+	for _, i := range found {
+		close(fetches[i].done)
+	}
+	return still
+}
+
+// fetchRuns fetches the runs of consecutive blocks at keys, stores them in
+// the caches and completes their fetches. Every fetch is completed, even on
+// error, so that no other goroutine is left waiting for one of its blocks.
+// The runs are written to the DiskCache, if any, only after that.
+func (r *FetchingReader) fetchRuns(ctx context.Context, keys []int64, fetches []*blockFetch, runs [][2]int, want [][2]int64) {
+	ranges := make([][2]int64, len(runs))
+	for i, run := range runs {
+		ranges[i] = [2]int64{keys[run[0]], int64((run[1] - run[0]) * r.fetchBytes)}
+	}
+	var data [][]byte
+	var version string
+	var err error
+	ctx, reported := r.observe(ctx, want)
+	start := time.Now()
+	if len(runs) == 1 {
+		var run []byte
+		run, version, err = r.source.ReadRange(ctx, ranges[0][0], int(ranges[0][1]))
+		data = [][]byte{run}
+	} else {
+		data, version, err = readRanges(ctx, r.source, ranges)
+	}
+	if !reported {
+		req := sentRequest{ranges: ranges, duration: time.Since(start), err: err}
+		if err == nil {
+			for k, rg := range ranges {
+				req.received = append(req.received, [2]int64{rg[0], int64(len(data[k]))})
+			}
+		}
+		r.record(r.requestEvent(req, want))
+	}
+	if errors.Is(err, ErrObjectChanged) && r.invalidateOnChange {
+		r.Invalidate()
+	}
+
+	r.mu.Lock()
+	for k, run := range runs {
+		for i := run[0]; i < run[1]; i++ {
+			f := fetches[i]
+			if err != nil {
+				f.err = err
+			} else {
+				start := minInt((i-run[0])*r.fetchBytes, len(data[k]))
+				end := minInt((i-run[0]+1)*r.fetchBytes, len(data[k]))
+				f.data = bytes.Clone(data[k][start:end])
+				r.cache.Add(r.blockKey(version, keys[i]), f.data)
+			}
+			delete(r.inFlight, keys[i])
+		}
+	}
+	r.mu.Unlock()
+
+	for _, run := range runs {
+		for _, f := range fetches[run[0]:run[1]] {
+			close(f.done)
+		}
+	}
+
+	if err == nil && r.disk != nil {
+		for k, run := range runs {
+			r.disk.addRun(r.blockKey(version, keys[run[0]]), data[k])
+		}
+	}
+}
+
+func (r *FetchingReader) getDataAt(ctx context.Context, off int64, nrBytes int) ([]byte, error) {
 	keys := r.getKeysFor(off, nrBytes)
+	blocks, err := r.getDataForKeys(ctx, keys, [][2]int64{{off, int64(nrBytes)}})
+	if err != nil {
+		return nil, err
+	}
+	return r.assemble(off, nrBytes, keys, blocks), nil
+}
 
+// assemble copies nrBytes bytes at off out of blocks, which hold the data at
+// keys as returned by getKeysFor. The result is shorter than nrBytes if the
+// end of the file is reached.
+func (r *FetchingReader) assemble(off int64, nrBytes int, keys []int64, blocks [][]byte) []byte {
 	outputData := make([]byte, nrBytes)
 	outputPos := 0
 
 	for j, key := range keys {
-		keyData, err := r.getDataForKey(key)
-		if err != nil {
-			return outputData, err
-		}
+		keyData := blocks[j]
 
 		var startIndex int64 = 0
 		if j <= 0 {
@@ -102,16 +559,31 @@ func (r *FetchingReader) getDataAt(off int64, nrBytes int) ([]byte, error) {
 		if j >= len(keys)-1 {
 			endIndex = (off + int64(nrBytes)) - key
 		}
-		// if (startIndex == 0 && endIndex == int64(r.fetchBytes)) {
-		// 	copy(outputData,
-		// }
-		for i := startIndex; i < endIndex; i++ {
-			outputData[outputPos] = keyData[i]
-			outputPos += 1
+		if endIndex > int64(len(keyData)) {
+			// A short block means we ran into the end of the file.
+			if startIndex < int64(len(keyData)) {
+				outputPos += copy(outputData[outputPos:], keyData[startIndex:])
+			}
+			return outputData[:outputPos]
 		}
+		outputPos += copy(outputData[outputPos:], keyData[startIndex:endIndex])
 	}
 
-	return outputData, nil
+	return outputData
+}
+
+func minInt(a, b int) int {
+	if a <= b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a >= b {
+		return a
+	}
+	return b
 }
 
 /*
@@ -124,28 +596,105 @@ func (r *FetchingReader) getDataAt(off int64, nrBytes int) ([]byte, error) {
 * Implementations must not retain p.
  */
 func (r *FetchingReader) ReadAt(p []byte, off int64) (n int, err error) {
+	return r.ReadAtContext(context.Background(), p, off)
+}
+
+// ReadAtContext is ReadAt, except that ctx ends the requests it makes. A
+// block another goroutine is fetching is not waited for past ctx either.
+// Reads at or beyond the end of the file return io.EOF.
+func (r *FetchingReader) ReadAtContext(ctx context.Context, p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, errors.New("ReadAt: negative offset")
+	}
 	nrBytes := len(p)
-	data, err := r.getDataAt(off, nrBytes)
+	if size := knownSize(r.source); size >= 0 {
+		if off >= size {
+			return 0, io.EOF
+		}
+		if int64(nrBytes) > size-off {
+			nrBytes = int(size - off)
+		}
+	}
+	data, err := r.getDataAt(ctx, off, nrBytes)
 	if err != nil {
 		return 0, err
 	}
-	copy(p, data)
-	if len(data) < len(p) {
-		return len(data), fmt.Errorf("something went wrong ... did you reach the end of the file?")
+	n = copy(p, data)
+	if n < len(p) {
+		return n, io.EOF
 	}
-	return len(data), nil
+	return n, nil
 }
 
-// Size() is used as a probe to determine wether the given key exists, and should return
-// an error if no such key exists. The actual file size may or may not be effectively used
-// depending on the underlying GDAL driver opening the file
-//
-// It may also optionally implement KeyMultiReader which will be used (only?) by
-// the GTiff driver when reading pixels. If not provided, this
-// VSI implementation will concurrently call ReadAt([]byte,int64)
-func (r *FetchingReader) Size(key string) (int64, error) {
-	size, err := fetchSize(r.fileUrl)
-	return int64(size), err
+// ReadAtMulti reads len(bufs[i]) bytes at offs[i] into each of bufs, fetching
+// all missing blocks in a single multi-range request where the server
+// supports it. It implements godal's KeyMultiReader; key is ignored.
+func (r *FetchingReader) ReadAtMulti(key string, bufs [][]byte, offs []int64) ([]int, error) {
+	return r.ReadAtMultiContext(context.Background(), bufs, offs)
+}
+
+// ReadAtMultiContext is ReadAtMulti, except that ctx ends the requests it
+// makes, as for ReadAtContext.
+func (r *FetchingReader) ReadAtMultiContext(ctx context.Context, bufs [][]byte, offs []int64) ([]int, error) {
+	if len(bufs) != len(offs) {
+		return nil, errors.New("ReadAtMultiContext: bufs and offs differ in length")
+	}
+
+	var keys []int64
+	want := make([][2]int64, len(bufs))
+	for i, buf := range bufs {
+		keys = append(keys, r.getKeysFor(offs[i], len(buf))...)
+		want[i] = [2]int64{offs[i], int64(len(buf))}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	unique := keys[:0]
+	for i, k := range keys {
+		if i == 0 || k != keys[i-1] {
+			unique = append(unique, k)
+		}
+	}
+	keys = unique
+
+	blocks, err := r.getDataForKeys(ctx, keys, want)
+	if err != nil {
+		return nil, err
+	}
+
+	ns := make([]int, len(bufs))
+	err = nil
+	for i, buf := range bufs {
+		if len(buf) == 0 {
+			continue
+		}
+		first := sort.Search(len(keys), func(k int) bool { return keys[k] > offs[i] }) - 1
+		bufKeys := r.getKeysFor(offs[i], len(buf))
+		data := r.assemble(offs[i], len(buf), bufKeys, blocks[first:first+len(bufKeys)])
+		ns[i] = copy(buf, data)
+		if ns[i] < len(buf) {
+			err = io.ErrUnexpectedEOF
+		}
+	}
+	return ns, err
+}
+
+// Size returns the length of the file. It is taken from the first response
+// that tells it, or else asked for with a HEAD request. godal's VSI handlers
+// call Size with a key; NewVSIReader provides that signature.
+func (r *FetchingReader) Size() (int64, error) {
+	ctx, _ := r.observe(context.Background(), nil)
+	size, err := r.source.Size(ctx)
+	if errors.Is(err, ErrObjectChanged) && r.invalidateOnChange {
+		r.Invalidate()
+	}
+	return size, err
+}
+
+// Close closes the source of r if it needs closing, as a LocalSource does.
+func (r *FetchingReader) Close() error {
+	if closer, ok := r.source.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
 }
 
 /*
@@ -177,9 +726,15 @@ func (r *FetchingReader) Size(key string) (int64, error) {
 * Implementations must not retain p.
  */
 func (r *FetchingReader) Read(p []byte) (n int, err error) {
+	r.mu.Lock()
 	off := r.currentLocation
+	r.mu.Unlock()
+
 	nrBytesRead, err := r.ReadAt(p, off)
+
+	r.mu.Lock()
 	r.currentLocation += int64(nrBytesRead)
+	r.mu.Unlock()
 	return nrBytesRead, err
 }
 
@@ -198,6 +753,18 @@ func (r *FetchingReader) Read(p []byte) (n int, err error) {
 * is implementation-dependent.
  */
 func (r *FetchingReader) Seek(offset int64, whence int) (int64, error) {
+	var size int64
+	if whence == io.SeekEnd {
+		// Asking for the size may take a request, so do it before locking.
+		var err error
+		if size, err = r.Size(); err != nil {
+			return 0, err
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
 	switch whence {
 	default:
 		return 0, errors.New("Seek: invalid whence")
@@ -205,8 +772,8 @@ func (r *FetchingReader) Seek(offset int64, whence int) (int64, error) {
 		break
 	case io.SeekCurrent:
 		offset += r.currentLocation
-		// case io.SeekEnd:
-		// 	offset += s.limit
+	case io.SeekEnd:
+		offset += size
 	}
 	if offset < 0 {
 		return 0, errors.New("Seek: invalid offset")
@@ -0,0 +1,229 @@
+package selfmade
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// checkRead reads n bytes at off from r and checks they are those of data.
+// It may be called from any goroutine.
+func checkRead(t *testing.T, r io.ReaderAt, data []byte, off int64, n int) {
+	t.Helper()
+	p := make([]byte, n)
+	if _, err := r.ReadAt(p, off); err != nil {
+		t.Errorf("ReadAt(%d bytes at %d): %v", n, off, err)
+	} else if !bytes.Equal(p, data[off:off+int64(n)]) {
+		t.Errorf("ReadAt(%d bytes at %d) returned the wrong data", n, off)
+	}
+}
+
+func TestFetchingReaderConcurrent(t *testing.T) {
+	data := testData(100000)
+	store := newStubStore(t)
+	store.put("/a.tif", data)
+	store.delay = 20 * time.Millisecond
+	r := MakeFetchingReaderWithOptions(store.url("/a.tif"), Options{HeaderBytes: -1})
+
+	// All readers need the same block, which is fetched only once.
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			checkRead(t, r, data, 1000, 100)
+		}()
+	}
+	wg.Wait()
+	if n := store.count(); n != 1 {
+		t.Errorf("sent %d requests for one block, want 1", n)
+	}
+
+	// Readers of different parts get what they asked for.
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(off int64) {
+			defer wg.Done()
+			checkRead(t, r, data, off, 3000)
+		}(int64(i) * 6000)
+	}
+	wg.Wait()
+}
+
+func TestFetchingReaderCoalesce(t *testing.T) {
+	data := testData(100000)
+	store := newStubStore(t)
+	store.put("/a.tif", data)
+	r := MakeFetchingReaderWithOptions(store.url("/a.tif"), Options{HeaderBytes: -1})
+
+	checkRead(t, r, data, 9000, 5000) // blocks 8000 and 12000
+	checkRead(t, r, data, 1, 30000)   // blocks 0 to 28000
+	want := []string{"bytes=8000-15999", "bytes=0-7999,16000-31999"}
+	if got := store.ranges(); !reflect.DeepEqual(got, want) {
+		t.Errorf("sent ranges %q, want %q", got, want)
+	}
+}
+
+func TestFetchingReaderHeaderPrefetch(t *testing.T) {
+	data := testData(300000)
+	store := newStubStore(t)
+	store.put("/a.tif", data)
+	r := MakeFetchingReader(store.url("/a.tif"))
+
+	checkRead(t, r, data, 0, 100)
+	checkRead(t, r, data, 30000, 100)
+	checkRead(t, r, data, 60000, 100)
+	want := []string{"bytes=0-67999"}
+	if got := store.ranges(); !reflect.DeepEqual(got, want) {
+		t.Errorf("sent ranges %q, want %q", got, want)
+	}
+
+	// A read after the header does not fetch it again.
+	store.reset()
+	r.Invalidate()
+	checkRead(t, r, data, 100000, 100)
+	if got := store.ranges(); !reflect.DeepEqual(got, []string{"bytes=100000-103999"}) {
+		t.Errorf("sent ranges %q for a read after the header", got)
+	}
+}
+
+func TestFetchingReaderReadahead(t *testing.T) {
+	data := testData(300000)
+	store := newStubStore(t)
+	store.put("/a.tif", data)
+	r := MakeFetchingReaderWithOptions(store.url("/a.tif"), Options{HeaderBytes: -1, BlockSize: 1000, MaxReadahead: 4000})
+
+	for off := int64(100000); off < 120000; off += 1000 {
+		checkRead(t, r, data, off, 1000)
+	}
+	// The readahead doubles with every sequential read up to 4 blocks. Reads
+	// finding their block read ahead already send no request.
+	want := []string{
+		"bytes=100000-100999",
+		"bytes=101000-102999",
+		"bytes=103000-107999",
+		"bytes=108000-112999",
+		"bytes=113000-117999",
+		"bytes=118000-122999",
+	}
+	if got := store.ranges(); !reflect.DeepEqual(got, want) {
+		t.Errorf("sent ranges %q, want %q", got, want)
+	}
+
+	// A read elsewhere starts over.
+	store.reset()
+	checkRead(t, r, data, 200000, 1000)
+	if got := store.ranges(); !reflect.DeepEqual(got, []string{"bytes=200000-200999"}) {
+		t.Errorf("sent ranges %q after a jump", got)
+	}
+}
+
+func TestFetchingReaderEOF(t *testing.T) {
+	data := testData(10000)
+	store := newStubStore(t)
+	store.put("/a.tif", data)
+	r := MakeFetchingReaderWithOptions(store.url("/a.tif"), Options{HeaderBytes: -1})
+
+	p := make([]byte, 100)
+	if n, err := r.ReadAt(p, 9950); n != 50 || err != io.EOF || !bytes.Equal(p[:n], data[9950:]) {
+		t.Errorf("ReadAt across the end = %d, %v, want 50, EOF", n, err)
+	}
+	for _, off := range []int64{10000, 20000} {
+		if n, err := r.ReadAt(p, off); n != 0 || err != io.EOF {
+			t.Errorf("ReadAt(%d) = %d, %v, want 0, EOF", off, n, err)
+		}
+	}
+	if _, err := r.ReadAt(p, -1); err == nil {
+		t.Error("ReadAt at a negative offset succeeded")
+	}
+}
+
+func TestFetchingReaderSize(t *testing.T) {
+	data := testData(10000)
+	store := newStubStore(t)
+	store.put("/a.tif", data)
+
+	// Without a read before, the size takes a HEAD request, but only one.
+	r := MakeFetchingReaderWithOptions(store.url("/a.tif"), Options{HeaderBytes: -1})
+	for i := 0; i < 2; i++ {
+		if size, err := r.Size(); err != nil || size != int64(len(data)) {
+			t.Fatalf("Size = %d, %v, want %d", size, err, len(data))
+		}
+	}
+	if log := store.log(); len(log) != 1 || log[0].Method != http.MethodHead {
+		t.Errorf("sent %+v, want one HEAD request", log)
+	}
+
+	// A range response tells the size as well.
+	store.reset()
+	r = MakeFetchingReaderWithOptions(store.url("/a.tif"), Options{HeaderBytes: -1})
+	checkRead(t, r, data, 0, 10)
+	if size, err := r.Size(); err != nil || size != int64(len(data)) {
+		t.Fatalf("Size = %d, %v, want %d", size, err, len(data))
+	}
+	if n := store.count(); n != 1 {
+		t.Errorf("sent %d requests, want only the GET", n)
+	}
+}
+
+func TestFetchingReaderSeek(t *testing.T) {
+	data := testData(10000)
+	r := MakeFetchingReaderFromSource("mem://seek", NewMemSource(data), Options{})
+
+	if pos, err := r.Seek(-50, io.SeekEnd); err != nil || pos != 9950 {
+		t.Fatalf("Seek(-50, SeekEnd) = %d, %v", pos, err)
+	}
+	b, err := io.ReadAll(r)
+	if err != nil || !bytes.Equal(b, data[9950:]) {
+		t.Errorf("ReadAll after SeekEnd = %d bytes, %v", len(b), err)
+	}
+	if pos, err := r.Seek(-100, io.SeekCurrent); err != nil || pos != 9900 {
+		t.Errorf("Seek(-100, SeekCurrent) = %d, %v", pos, err)
+	}
+	if _, err := r.Seek(-1, io.SeekStart); err == nil {
+		t.Error("Seek before the start succeeded")
+	}
+	b, err = io.ReadAll(io.NewSectionReader(r, 0, int64(len(data))))
+	if err != nil || !bytes.Equal(b, data) {
+		t.Errorf("reading all through a SectionReader = %d bytes, %v", len(b), err)
+	}
+}
+
+func TestFetchingReaderCancel(t *testing.T) {
+	data := testData(10000)
+	store := newStubStore(t)
+	store.put("/a.tif", data)
+	store.delay = 300 * time.Millisecond
+	r := MakeFetchingReaderWithOptions(store.url("/a.tif"), Options{HeaderBytes: -1})
+
+	// The cancelled read returns right away, while another waiting for the
+	// same block gets it once its own request is done.
+	other := make(chan error)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	go func() {
+		_, err := r.ReadAtContext(ctx, make([]byte, 10), 0)
+		other <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		checkRead(t, r, data, 0, 10)
+	}()
+
+	start := time.Now()
+	if err := <-other; !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("cancelled read: got %v, want %v", err, context.DeadlineExceeded)
+	}
+	if d := time.Since(start); d > 200*time.Millisecond {
+		t.Errorf("cancelled read returned after %v", d)
+	}
+	<-done
+}
@@ -0,0 +1,261 @@
+package selfmade
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// HTTPSource is a RangeSource reading a single url with http range requests.
+// It is configured by the request related fields of Options, and identifies
+// versions of the file by their ETag or Last-Modified header.
+type HTTPSource struct {
+	fileUrl string
+	opts    Options
+	retry   RetryPolicy
+
+	// mu guards known, the validators of the version of the file we read,
+	// size, its length or -1 while unknown, and noMultiRange, whether the
+	// server is known not to support multi-range requests.
+	mu           sync.Mutex
+	known        validator
+	size         int64
+	noMultiRange bool
+}
+
+// NewHTTPSource returns a source reading fileUrl. Of opts, only the fields
+// about requests are used.
+func NewHTTPSource(fileUrl string, opts Options) *HTTPSource {
+	retry := DefaultRetryPolicy
+	if opts.Retry != nil {
+		retry = *opts.Retry
+	}
+	return &HTTPSource{fileUrl: fileUrl, opts: opts, retry: retry, size: -1}
+}
+
+// newRequest returns a request for c.fileUrl carrying all headers and
+// credentials from the options.
+func (c *HTTPSource) newRequest(ctx context.Context, method string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.fileUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range c.opts.Header {
+		for _, value := range values {
+			req.Header.Add(key, value)
+		}
+	}
+	if c.opts.UserAgent != "" {
+		req.Header.Set("User-Agent", c.opts.UserAgent)
+	}
+	if c.opts.Username != "" {
+		req.SetBasicAuth(c.opts.Username, c.opts.Password)
+	}
+	if c.opts.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+c.opts.BearerToken)
+	}
+	c.setConditions(req)
+	return req, nil
+}
+
+// do sends req after passing it to the PrepareRequest hook, if any.
+func (c *HTTPSource) do(req *http.Request) (*http.Response, error) {
+	if c.opts.PrepareRequest != nil {
+		if err := c.opts.PrepareRequest(req); err != nil {
+			return nil, err
+		}
+	}
+	client := c.opts.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return client.Do(req)
+}
+
+// reportsRequests makes c a requestReporter.
+func (c *HTTPSource) reportsRequests() {}
+
+func (c *HTTPSource) logf(format string, v ...any) {
+	if c.opts.Logger != nil {
+		c.opts.Logger.Printf(format, v...)
+	}
+}
+
+// Size returns the length of c.fileUrl. Unless an earlier response
+// told it already, it is asked for with a HEAD request.
+func (c *HTTPSource) Size(ctx context.Context) (size int64, err error) {
+	if size := c.knownSize(); size >= 0 {
+		return size, nil
+	}
+	err = c.retry.do(ctx, func() error {
+		start := time.Now()
+		size, err = c.fetchSizeOnce(ctx)
+		reportRequest(ctx, sentRequest{duration: time.Since(start), err: err})
+		return err
+	})
+	return size, err
+}
+
+func (c *HTTPSource) fetchSizeOnce(ctx context.Context) (int64, error) {
+	c.logf("Getting size of %s", c.fileUrl)
+	req, err := c.newRequest(ctx, http.MethodHead)
+	if err != nil {
+		return 0, err
+	}
+
+	res, err := c.do(req)
+	if err != nil {
+		return 0, err
+	}
+	res.Body.Close()
+	if res.StatusCode == http.StatusPreconditionFailed {
+		return 0, ErrObjectChanged
+	}
+	if res.StatusCode != http.StatusOK {
+		return 0, statusError(res)
+	}
+	if _, err := c.checkVersion(res); err != nil {
+		return 0, err
+	}
+
+	contentLength := res.Header.Get("Content-Length")
+	if contentLength == "" {
+		return 0, ErrNoContentLength
+	}
+	size, err := strconv.ParseInt(contentLength, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid Content-Length %q: %v", contentLength, err)
+	}
+	c.learnSize(size)
+
+	return size, nil
+}
+
+// learnSize remembers size as the length of the file, unless it is negative,
+// which stands for unknown.
+func (c *HTTPSource) learnSize(size int64) {
+	if size < 0 {
+		return
+	}
+	c.mu.Lock()
+	c.size = size
+	c.mu.Unlock()
+}
+
+// knownSize returns the length of the file if a response told it, or -1.
+func (c *HTTPSource) knownSize() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.size
+}
+
+// fetchRange fetches nrBytes bytes of c.fileUrl starting at startByte. The
+// result is shorter than nrBytes only if the file ends before. It also
+// returns the version of the file the data is from.
+func (c *HTTPSource) fetchRange(ctx context.Context, startByte int64, nrBytes int) (data []byte, version string, err error) {
+	err = c.retry.do(ctx, func() error {
+		start := time.Now()
+		data, version, err = c.fetchRangeOnce(ctx, startByte, nrBytes)
+		if nrBytes > 0 {
+			// A range beyond the end of the file is no failure of ReadRange.
+			reqErr := err
+			var notSatisfiable *RangeNotSatisfiableError
+			if errors.As(err, &notSatisfiable) {
+				reqErr = nil
+			}
+			reportRequest(ctx, sentRequest{
+				ranges:   [][2]int64{{startByte, int64(nrBytes)}},
+				received: [][2]int64{{startByte, int64(len(data))}},
+				duration: time.Since(start),
+				err:      reqErr,
+			})
+		}
+		return err
+	})
+	return data, version, err
+}
+
+func (c *HTTPSource) fetchRangeOnce(ctx context.Context, startByte int64, nrBytes int) ([]byte, string, error) {
+	if nrBytes <= 0 {
+		return []byte{}, c.Version(), nil
+	}
+	lastByte := startByte + int64(nrBytes) - 1
+	c.logf("Fetching bytes %d-%d", startByte, lastByte)
+	req, err := c.newRequest(ctx, http.MethodGet)
+	if err != nil {
+		return nil, "", err
+	}
+	rangeSpec := fmt.Sprintf("bytes=%d-%d", startByte, lastByte)
+	req.Header.Set("Range", rangeSpec)
+
+	res, err := c.do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer res.Body.Close()
+
+	if err := checkRangeStatus(res, rangeSpec); err != nil {
+		return nil, "", err
+	}
+	version, err := c.checkVersion(res)
+	if err != nil {
+		return nil, "", err
+	}
+	first, last, size, err := parseContentRange(res.Header.Get("Content-Range"))
+	if err != nil {
+		return nil, "", err
+	}
+	if first != startByte || last > lastByte {
+		return nil, "", fmt.Errorf("asked for %s but got bytes %d-%d", rangeSpec, first, last)
+	}
+	c.learnSize(size)
+	if last < lastByte && last != size-1 {
+		return nil, "", &ShortReadError{Want: int64(nrBytes), Got: last - first + 1}
+	}
+
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	if int64(len(data)) != last-first+1 {
+		return nil, "", &ShortReadError{Want: last - first + 1, Got: int64(len(data))}
+	}
+
+	return data, version, nil
+}
+
+// ReadRange is fetchRange, except that a range starting at or beyond the end
+// of the file yields no data instead of an error.
+func (c *HTTPSource) ReadRange(ctx context.Context, startByte int64, nrBytes int) ([]byte, string, error) {
+	data, version, err := c.fetchRange(ctx, startByte, nrBytes)
+	var notSatisfiable *RangeNotSatisfiableError
+	if errors.As(err, &notSatisfiable) {
+		c.learnSize(notSatisfiable.Size)
+		return []byte{}, c.Version(), nil
+	}
+	return data, version, err
+}
+
+// checkRangeStatus returns an error for any answer to a range request other
+// than 206 Partial Content.
+func checkRangeStatus(res *http.Response, rangeSpec string) error {
+	switch res.StatusCode {
+	case http.StatusPartialContent:
+		return nil
+	case http.StatusOK:
+		return ErrRangeIgnored
+	case http.StatusPreconditionFailed:
+		return ErrObjectChanged
+	case http.StatusRequestedRangeNotSatisfiable:
+		// The Content-Range of a 416 has the form "bytes */size".
+		size := int64(-1)
+		fmt.Sscanf(res.Header.Get("Content-Range"), "bytes */%d", &size)
+		return &RangeNotSatisfiableError{Range: rangeSpec, Size: size}
+	}
+	return statusError(res)
+}
@@ -0,0 +1,231 @@
+package selfmade
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// noRetry makes a source give up after the first attempt.
+var noRetry = &RetryPolicy{MaxAttempts: 1}
+
+func TestHTTPSourceReadRange(t *testing.T) {
+	data := testData(100)
+	for _, test := range []struct {
+		name    string
+		handler http.HandlerFunc
+		off     int64
+		n       int
+		want    []byte
+		wantErr func(error) bool
+	}{{
+		name:    "206",
+		handler: func(w http.ResponseWriter, r *http.Request) { serveData(w, r, data) },
+		off:     10, n: 20,
+		want: data[10:30],
+	}, {
+		name:    "206 at the end of the file",
+		handler: func(w http.ResponseWriter, r *http.Request) { serveData(w, r, data) },
+		off:     90, n: 20,
+		want: data[90:],
+	}, {
+		name:    "416 beyond the end of the file",
+		handler: func(w http.ResponseWriter, r *http.Request) { serveData(w, r, data) },
+		off:     200, n: 20,
+		want: []byte{},
+	}, {
+		name: "200 for a range",
+		handler: func(w http.ResponseWriter, r *http.Request) {
+			w.Write(data)
+		},
+		off: 10, n: 20,
+		wantErr: func(err error) bool { return errors.Is(err, ErrRangeIgnored) },
+	}, {
+		name: "404",
+		handler: func(w http.ResponseWriter, r *http.Request) {
+			http.NotFound(w, r)
+		},
+		off: 10, n: 20,
+		wantErr: func(err error) bool {
+			var statusErr *StatusError
+			return errors.As(err, &statusErr) && statusErr.Code == http.StatusNotFound
+		},
+	}, {
+		name: "fewer bytes than asked for before the end",
+		handler: func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Range", "bytes 10-19/100")
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(data[10:20])
+		},
+		off: 10, n: 20,
+		wantErr: func(err error) bool {
+			var shortRead *ShortReadError
+			return errors.As(err, &shortRead) && shortRead.Want == 20 && shortRead.Got == 10
+		},
+	}, {
+		name: "other bytes than asked for",
+		handler: func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Range", "bytes 0-19/100")
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(data[:20])
+		},
+		off: 10, n: 20,
+		wantErr: func(err error) bool { return err != nil && strings.Contains(err.Error(), "got bytes 0-19") },
+	}, {
+		name: "body shorter than its Content-Length",
+		handler: func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Range", "bytes 10-29/100")
+			w.Header().Set("Content-Length", "20")
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(data[10:20])
+		},
+		off: 10, n: 20,
+		wantErr: func(err error) bool { return errors.Is(err, io.ErrUnexpectedEOF) },
+	}, {
+		name: "body shorter than its Content-Range",
+		handler: func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Range", "bytes 10-29/100")
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(data[10:20])
+		},
+		off: 10, n: 20,
+		wantErr: func(err error) bool {
+			var shortRead *ShortReadError
+			return errors.As(err, &shortRead) && shortRead.Got == 10
+		},
+	}, {
+		name: "invalid Content-Range",
+		handler: func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Range", "bytes 10-/100")
+			w.WriteHeader(http.StatusPartialContent)
+		},
+		off: 10, n: 20,
+		wantErr: func(err error) bool { return err != nil && strings.Contains(err.Error(), "invalid Content-Range") },
+	}} {
+		t.Run(test.name, func(t *testing.T) {
+			srv := httptest.NewServer(test.handler)
+			defer srv.Close()
+			c := NewHTTPSource(srv.URL, Options{Retry: noRetry})
+			got, _, err := c.ReadRange(context.Background(), test.off, test.n)
+			if test.wantErr != nil {
+				if !test.wantErr(err) {
+					t.Errorf("got error %v", err)
+				}
+				return
+			}
+			if err != nil || !bytes.Equal(got, test.want) {
+				t.Errorf("got %d bytes, %v, want %d bytes", len(got), err, len(test.want))
+			}
+		})
+	}
+}
+
+func TestHTTPSourceSize(t *testing.T) {
+	data := testData(100)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/unknown" {
+			// Flushing sends the headers before the length is known.
+			w.(http.Flusher).Flush()
+			return
+		}
+		serveData(w, r, data)
+	}))
+	defer srv.Close()
+
+	if size, err := NewHTTPSource(srv.URL, Options{}).Size(context.Background()); err != nil || size != 100 {
+		t.Errorf("Size = %d, %v, want 100", size, err)
+	}
+	if _, err := NewHTTPSource(srv.URL+"/unknown", Options{}).Size(context.Background()); !errors.Is(err, ErrNoContentLength) {
+		t.Errorf("Size without Content-Length: got %v, want %v", err, ErrNoContentLength)
+	}
+}
+
+func TestHTTPSourceRequestOptions(t *testing.T) {
+	store := newStubStore(t)
+	store.put("/a.tif", testData(1000))
+	read := func(opts Options) (http.Header, error) {
+		store.reset()
+		opts.HeaderBytes = -1
+		r := MakeFetchingReaderWithOptions(store.url("/a.tif"), opts)
+		_, err := r.ReadAt(make([]byte, 10), 0)
+		if log := store.log(); len(log) > 0 {
+			return log[0].Header, err
+		}
+		return nil, err
+	}
+
+	header, err := read(Options{
+		UserAgent: "gocog-test",
+		Header:    http.Header{"X-Test": {"1", "2"}},
+		Username:  "user",
+		Password:  "secret",
+		PrepareRequest: func(req *http.Request) error {
+			req.Header.Set("X-Signature", "signed")
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := http.Request{Header: header}
+	user, password, ok := req.BasicAuth()
+	if header.Get("User-Agent") != "gocog-test" || !reflect.DeepEqual(header.Values("X-Test"), []string{"1", "2"}) ||
+		!ok || user != "user" || password != "secret" || header.Get("X-Signature") != "signed" {
+		t.Errorf("request headers are %v", header)
+	}
+
+	if header, err = read(Options{BearerToken: "token"}); err != nil || header.Get("Authorization") != "Bearer token" {
+		t.Errorf("Authorization = %q, %v, want the bearer token", header.Get("Authorization"), err)
+	}
+
+	errHook := errors.New("cannot sign")
+	if _, err := read(Options{PrepareRequest: func(*http.Request) error { return errHook }}); !errors.Is(err, errHook) {
+		t.Errorf("failing PrepareRequest: got %v, want %v", err, errHook)
+	}
+	if n := store.count(); n != 0 {
+		t.Errorf("failing PrepareRequest: sent %d requests", n)
+	}
+}
+
+func TestHTTPSourceObjectChanged(t *testing.T) {
+	v1, v2 := testData(20000), bytes.Repeat([]byte{1}, 20000)
+	store := newStubStore(t)
+
+	for _, invalidate := range []bool{false, true} {
+		store.put("/a.tif", v1)
+		r := MakeFetchingReaderWithOptions(store.url("/a.tif"), Options{HeaderBytes: -1, InvalidateOnChange: invalidate})
+		checkRead(t, r, v1, 0, 100)
+		store.put("/a.tif", v2)
+
+		// Cached blocks are still read, but new ones must be of the version
+		// read before.
+		checkRead(t, r, v1, 0, 100)
+		store.reset()
+		if _, err := r.ReadAt(make([]byte, 100), 9000); !errors.Is(err, ErrObjectChanged) {
+			t.Fatalf("got %v, want %v", err, ErrObjectChanged)
+		}
+		if log := store.log(); len(log) != 1 || log[0].Header.Get("If-Match") != etag(v1) {
+			t.Errorf("sent %+v, want one request with If-Match %s", log, etag(v1))
+		}
+
+		_, err := r.ReadAt(make([]byte, 100), 9000)
+		if !invalidate {
+			if !errors.Is(err, ErrObjectChanged) {
+				t.Errorf("second read: got %v, want %v", err, ErrObjectChanged)
+			}
+			continue
+		}
+		// The reader dropped the old version and reads the new one.
+		if err != nil {
+			t.Errorf("read after invalidating: %v", err)
+		}
+		checkRead(t, r, v2, 0, 100)
+		checkRead(t, r, v2, 9000, 100)
+	}
+}
@@ -0,0 +1,122 @@
+package selfmade
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sync"
+)
+
+// LocalSource is a RangeSource reading a local file. Versions of the file are
+// told apart by its modification time and size.
+type LocalSource struct {
+	f *os.File
+
+	// mu guards known, the version of the file we read, and size, its
+	// length when last looked at.
+	mu    sync.Mutex
+	known string
+	size  int64
+}
+
+// OpenLocalSource opens the file at path.
+func OpenLocalSource(path string) (*LocalSource, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	s := &LocalSource{f: f, size: -1}
+	if _, _, err := s.check(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// openFileURL opens the local file of u. Files on other hosts, as in
+// file://host/share/file.tif, cannot be opened and are refused rather than
+// taken for the local file at the same path.
+func openFileURL(u *url.URL, opts Options) (RangeSource, error) {
+	if u.Host != "" && u.Host != "localhost" {
+		return nil, fmt.Errorf("file url %s names host %q; only local files can be opened", u, u.Host)
+	}
+	path := u.Path
+	if u.Opaque != "" {
+		path = u.Opaque
+	}
+	return OpenLocalSource(path)
+}
+
+// check returns the current version and size of the file, and an error
+// wrapping ErrObjectChanged if the version is not the one read before.
+func (s *LocalSource) check() (string, int64, error) {
+	info, err := s.f.Stat()
+	if err != nil {
+		return "", 0, err
+	}
+	version := fmt.Sprintf("%d-%d", info.ModTime().UnixNano(), info.Size())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.known == "" {
+		s.known = version
+	}
+	if version != s.known {
+		return "", 0, fmt.Errorf("%w: was %s, now %s", ErrObjectChanged, s.known, version)
+	}
+	s.size = info.Size()
+	return version, info.Size(), nil
+}
+
+func (s *LocalSource) ReadRange(ctx context.Context, off int64, n int) ([]byte, string, error) {
+	version, size, err := s.check()
+	if err != nil {
+		return nil, "", err
+	}
+	if off >= size {
+		return []byte{}, version, nil
+	}
+	if int64(n) > size-off {
+		n = int(size - off)
+	}
+	data := make([]byte, n)
+	got, err := s.f.ReadAt(data, off)
+	if err == io.EOF {
+		// The file shrank since we looked at it.
+		_, _, err = s.check()
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return data[:got], version, nil
+}
+
+func (s *LocalSource) Size(ctx context.Context) (int64, error) {
+	_, size, err := s.check()
+	return size, err
+}
+
+func (s *LocalSource) Version() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.known
+}
+
+func (s *LocalSource) ForgetVersion() {
+	s.mu.Lock()
+	s.known = ""
+	s.mu.Unlock()
+}
+
+func (s *LocalSource) knownSize() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.size
+}
+
+// Close closes the file.
+func (s *LocalSource) Close() error {
+	return s.f.Close()
+}
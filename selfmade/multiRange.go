@@ -0,0 +1,231 @@
+package selfmade
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// byteRange is a part of a range response: the bytes of the file starting at
+// start. size is the length of the whole file, or -1 if the server did not
+// tell.
+type byteRange struct {
+	start int64
+	data  []byte
+	size  int64
+}
+
+// parseContentRange parses a Content-Range header of the form
+// "bytes first-last/size", where size may be "*".
+func parseContentRange(header string) (first, last, size int64, err error) {
+	var sizeStr string
+	if _, err = fmt.Sscanf(header, "bytes %d-%d/%s", &first, &last, &sizeStr); err != nil {
+		return 0, 0, 0, fmt.Errorf("invalid Content-Range %q: %v", header, err)
+	}
+	size = -1
+	if sizeStr != "*" {
+		if _, err = fmt.Sscanf(sizeStr, "%d", &size); err != nil {
+			return 0, 0, 0, fmt.Errorf("invalid Content-Range %q: %v", header, err)
+		}
+	}
+	if first < 0 || last < first {
+		return 0, 0, 0, fmt.Errorf("invalid Content-Range %q", header)
+	}
+	return first, last, size, nil
+}
+
+// readByteRanges reads the parts of a 206 response, which is either a
+// multipart/byteranges body or a single range described by the Content-Range
+// header.
+func readByteRanges(res *http.Response) ([]byteRange, error) {
+	mediaType, params, err := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/byteranges" {
+		part, err := readByteRange(res.Header.Get("Content-Range"), res.Body)
+		if err != nil {
+			return nil, err
+		}
+		return []byteRange{part}, nil
+	}
+
+	var parts []byteRange
+	mr := multipart.NewReader(res.Body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return parts, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		br, err := readByteRange(part.Header.Get("Content-Range"), part)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, br)
+	}
+}
+
+// readByteRange reads the bytes described by contentRange from r.
+func readByteRange(contentRange string, r io.Reader) (byteRange, error) {
+	first, last, size, err := parseContentRange(contentRange)
+	if err != nil {
+		return byteRange{}, err
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return byteRange{}, err
+	}
+	if int64(len(data)) != last-first+1 {
+		return byteRange{}, &ShortReadError{Want: last - first + 1, Got: int64(len(data))}
+	}
+	return byteRange{start: first, data: data, size: size}, nil
+}
+
+// ReadRanges fetches several ranges of c.fileUrl, given as [start, length]
+// pairs, asking for all of them in a single request. Servers may answer such
+// a request with all ranges, a single one, or the whole file; any range the
+// response does not contain is fetched with a request of its own. Once a
+// server has answered with the whole file or refused the ranges as a whole,
+// it is taken not to support multi-range requests and every later call asks
+// for each range on its own right away. It also returns the version of the
+// file the data is from.
+func (c *HTTPSource) ReadRanges(ctx context.Context, ranges [][2]int64) ([][]byte, string, error) {
+	var parts []byteRange
+	var version string
+	versionKnown := false
+	if !c.singleRanges() {
+		err := c.retry.do(ctx, func() (err error) {
+			start := time.Now()
+			parts, version, err = c.fetchRangesOnce(ctx, ranges)
+			req := sentRequest{ranges: ranges, duration: time.Since(start), err: err}
+			for _, part := range parts {
+				req.received = append(req.received, [2]int64{part.start, int64(len(part.data))})
+			}
+			reportRequest(ctx, req)
+			return err
+		})
+		if err != nil {
+			return nil, "", err
+		}
+		versionKnown = true
+	}
+
+	out := make([][]byte, len(ranges))
+	for i, rg := range ranges {
+		for _, part := range parts {
+			end := part.start + int64(len(part.data))
+			if rg[0] < part.start || rg[0] >= end {
+				continue
+			}
+			// A part may end before the range does only at the end of the file.
+			if rg[0]+rg[1] > end && end != part.size {
+				continue
+			}
+			if rg[0]+rg[1] < end {
+				end = rg[0] + rg[1]
+			}
+			out[i] = part.data[rg[0]-part.start : end-part.start]
+			break
+		}
+		if out[i] == nil {
+			data, partVersion, err := c.ReadRange(ctx, rg[0], int(rg[1]))
+			if err != nil {
+				return nil, "", err
+			}
+			if versionKnown && partVersion != version {
+				return nil, "", fmt.Errorf("%w: was %s, now %s", ErrObjectChanged, version, partVersion)
+			}
+			out[i], version, versionKnown = data, partVersion, true
+		}
+	}
+	return out, version, nil
+}
+
+// singleRanges reports whether c asks for each range on its own instead of
+// sending multi-range requests.
+func (c *HTTPSource) singleRanges() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.noMultiRange
+}
+
+// setSingleRanges makes c ask for each range on its own from now on.
+func (c *HTTPSource) setSingleRanges() {
+	c.mu.Lock()
+	c.noMultiRange = true
+	c.mu.Unlock()
+}
+
+// fetchRangesOnce sends the request for ReadRanges and returns the parts of
+// the response, if any, and the version of the file they are from.
+func (c *HTTPSource) fetchRangesOnce(ctx context.Context, ranges [][2]int64) ([]byteRange, string, error) {
+	specs := make([]string, len(ranges))
+	for i, rg := range ranges {
+		specs[i] = fmt.Sprintf("%d-%d", rg[0], rg[0]+rg[1]-1)
+	}
+	c.logf("Fetching bytes %s", strings.Join(specs, ","))
+	req, err := c.newRequest(ctx, http.MethodGet)
+	if err != nil {
+		return nil, "", err
+	}
+	rangeSpec := "bytes=" + strings.Join(specs, ",")
+	req.Header.Set("Range", rangeSpec)
+
+	res, err := c.do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer res.Body.Close()
+
+	// Neither the whole file of a 200 nor a 416 for the ranges as a whole
+	// helps here; both are handled by asking for each range on its own. Unless
+	// the 416 is right because all ranges lie beyond the end of the file, the
+	// server is taken not to support multi-range requests.
+	var parts []byteRange
+	var notSatisfiable *RangeNotSatisfiableError
+	switch err := checkRangeStatus(res, rangeSpec); {
+	case err == nil:
+		if parts, err = readByteRanges(res); err != nil {
+			return nil, "", err
+		}
+	case err == ErrRangeIgnored:
+		c.logf("Server ignored multi-range request, asking for ranges one by one from now on")
+		c.setSingleRanges()
+	case errors.As(err, &notSatisfiable):
+		c.learnSize(notSatisfiable.Size)
+		if !beyondEnd(ranges, notSatisfiable.Size) {
+			c.logf("Server refused multi-range request, asking for ranges one by one from now on")
+			c.setSingleRanges()
+		}
+	default:
+		return nil, "", err
+	}
+	version, err := c.checkVersion(res)
+	if err != nil {
+		return nil, "", err
+	}
+	for _, part := range parts {
+		c.learnSize(part.size)
+	}
+	return parts, version, nil
+}
+
+// beyondEnd reports whether all ranges start at or beyond size, the length of
+// the file, which is -1 if unknown.
+func beyondEnd(ranges [][2]int64, size int64) bool {
+	if size < 0 {
+		return false
+	}
+	for _, rg := range ranges {
+		if rg[0] < size {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,100 @@
+package selfmade
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestParseContentRange(t *testing.T) {
+	for _, test := range []struct {
+		header            string
+		first, last, size int64
+		wantErr           bool
+	}{
+		{"bytes 0-99/1000", 0, 99, 1000, false},
+		{"bytes 500-999/*", 500, 999, -1, false},
+		{"bytes 10-5/1000", 0, 0, 0, true},
+		{"bytes */1000", 0, 0, 0, true},
+		{"items 0-9/10", 0, 0, 0, true},
+		{"", 0, 0, 0, true},
+	} {
+		first, last, size, err := parseContentRange(test.header)
+		if (err != nil) != test.wantErr || first != test.first || last != test.last || size != test.size {
+			t.Errorf("parseContentRange(%q) = %d, %d, %d, %v", test.header, first, last, size, err)
+		}
+	}
+}
+
+func TestReadAtMulti(t *testing.T) {
+	data := testData(100000)
+	for _, test := range []struct {
+		name     string
+		multi    int
+		requests int // in total
+		multis   int // of them multi-range requests
+	}{
+		{"multipart", multipartRanges, 2, 2},
+		// The whole file or a refusal tells the server does not support
+		// multi-range requests; the ranges are asked for one by one then.
+		{"whole file", wholeFile, 6, 1},
+		{"refused", refuseRanges, 6, 1},
+		// A server answering with some of the ranges is asked for the rest.
+		{"first range", firstRange, 5, 2},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			store := newStubStore(t)
+			store.put("/a.tif", data)
+			store.multi = test.multi
+			r := MakeFetchingReaderWithOptions(store.url("/a.tif"), Options{HeaderBytes: -1})
+
+			for _, offs := range [][]int64{{100, 50000, 99990}, {20000, 70000}} {
+				bufs := make([][]byte, len(offs))
+				for i := range bufs {
+					bufs[i] = make([]byte, 10)
+				}
+				ns, err := r.ReadAtMulti("", bufs, offs)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for i, off := range offs {
+					if ns[i] != 10 || !bytes.Equal(bufs[i], data[off:off+10]) {
+						t.Errorf("range at %d holds the wrong data", off)
+					}
+				}
+			}
+			multis := 0
+			for _, rg := range store.ranges() {
+				if strings.Contains(rg, ",") {
+					multis++
+				}
+			}
+			if got := store.count(); got != test.requests || multis != test.multis {
+				t.Errorf("sent %d requests, %d of them multi-range, want %d and %d: %q",
+					got, multis, test.requests, test.multis, store.ranges())
+			}
+		})
+	}
+}
+
+func TestReadRangesBeyondEnd(t *testing.T) {
+	store := newStubStore(t)
+	store.put("/a.tif", testData(100))
+	c := NewHTTPSource(store.url("/a.tif"), Options{})
+
+	// A 416 for ranges that all lie beyond the end of the file is no reason
+	// to give up on multi-range requests.
+	parts, _, err := c.ReadRanges(context.Background(), [][2]int64{{200, 10}, {300, 10}})
+	if err != nil || len(parts) != 2 || len(parts[0]) != 0 || len(parts[1]) != 0 {
+		t.Fatalf("ReadRanges = %q, %v, want two empty ranges", parts, err)
+	}
+	if c.singleRanges() {
+		t.Error("multi-range requests were given up")
+	}
+
+	parts, _, err = c.ReadRanges(context.Background(), [][2]int64{{10, 10}, {95, 10}})
+	if err != nil || !bytes.Equal(parts[0], testData(100)[10:20]) || !bytes.Equal(parts[1], testData(100)[95:]) {
+		t.Errorf("ReadRanges = %q, %v", parts, err)
+	}
+}
@@ -0,0 +1,124 @@
+package selfmade
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"syscall"
+	"time"
+)
+
+// RetryPolicy controls how often and how patiently a failed request is
+// repeated. Requests are retried on timeouts, refused or reset connections,
+// truncated responses and the statuses in RetryableStatus. Errors that come
+// back the same every time, such as failed TLS verification, unknown hosts
+// or unsupported schemes, are not retried.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of times a request is sent. Values
+	// below 2 disable retrying.
+	MaxAttempts int
+	// InitialBackoff is the wait before the first retry. Every further retry
+	// waits Multiplier times longer than the one before, but never longer
+	// than MaxBackoff.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Multiplier     float64
+	// RetryableStatus lists the http statuses that are worth retrying. If
+	// nil, DefaultRetryableStatus is used.
+	RetryableStatus []int
+	// MaxRetryAfter bounds the wait a server may ask for in the Retry-After
+	// header of a 429 or 503 answer, which is waited instead of the backoff
+	// when longer. The request fails rather than wait longer. Zero means no
+	// bound.
+	MaxRetryAfter time.Duration
+}
+
+// DefaultRetryableStatus are the statuses retried unless a RetryPolicy says
+// otherwise: request timeout, too many requests and the transient 5xx.
+var DefaultRetryableStatus = []int{408, 429, 500, 502, 503, 504}
+
+// DefaultRetryPolicy is used by a FetchingReader whose Options do not set
+// one.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    4,
+	InitialBackoff: 100 * time.Millisecond,
+	MaxBackoff:     2 * time.Second,
+	Multiplier:     2,
+	MaxRetryAfter:  30 * time.Second,
+}
+
+// do calls try until it succeeds, fails with an error that is not worth
+// retrying, the attempts are used up or ctx is done.
+func (p *RetryPolicy) do(ctx context.Context, try func() error) error {
+	backoff := p.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		err := try()
+		if err == nil || attempt >= p.MaxAttempts || !p.retryable(err) {
+			return err
+		}
+		wait := backoff
+		var statusErr *StatusError
+		if errors.As(err, &statusErr) && statusErr.RetryAfter > wait {
+			if p.MaxRetryAfter > 0 && statusErr.RetryAfter > p.MaxRetryAfter {
+				return err
+			}
+			wait = statusErr.RetryAfter
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+
+		multiplier := p.Multiplier
+		if multiplier < 1 {
+			multiplier = 1
+		}
+		backoff = time.Duration(float64(backoff) * multiplier)
+		if p.MaxBackoff > 0 && backoff > p.MaxBackoff {
+			backoff = p.MaxBackoff
+		}
+	}
+}
+
+// retryable tells whether a request that failed with err may succeed when
+// sent again.
+func (p *RetryPolicy) retryable(err error) bool {
+	var statusErr *StatusError
+	var shortRead *ShortReadError
+	var urlErr *url.Error
+	var netErr net.Error
+	var dnsErr *net.DNSError
+	switch {
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return false
+	case errors.As(err, &statusErr):
+		retryableStatus := p.RetryableStatus
+		if retryableStatus == nil {
+			retryableStatus = DefaultRetryableStatus
+		}
+		for _, code := range retryableStatus {
+			if code == statusErr.Code {
+				return true
+			}
+		}
+		return false
+	case errors.As(err, &shortRead), errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.ECONNREFUSED),
+		errors.Is(err, syscall.ECONNABORTED), errors.Is(err, syscall.EPIPE):
+		return true
+	case errors.As(err, &dnsErr):
+		return dnsErr.IsTimeout || dnsErr.IsTemporary
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return true
+	case errors.As(err, &urlErr) && errors.Is(urlErr.Err, io.EOF):
+		// The server closed a kept-alive connection before answering.
+		return true
+	}
+	return false
+}
@@ -0,0 +1,203 @@
+package selfmade
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// timeoutError is a net.Error that timed out.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestRetryable(t *testing.T) {
+	urlErr := func(err error) error { return &url.Error{Op: "Get", URL: "https://example.com/a.tif", Err: err} }
+	opErr := func(err error) error { return &net.OpError{Op: "dial", Net: "tcp", Err: err} }
+	for _, test := range []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"503", &StatusError{Code: 503}, true},
+		{"429", &StatusError{Code: 429}, true},
+		{"404", &StatusError{Code: 404}, false},
+		{"short read", &ShortReadError{Want: 10, Got: 5}, true},
+		{"truncated body", fmt.Errorf("reading body: %w", io.ErrUnexpectedEOF), true},
+		{"connection refused", urlErr(opErr(syscall.ECONNREFUSED)), true},
+		{"connection reset", urlErr(opErr(syscall.ECONNRESET)), true},
+		{"timeout", urlErr(timeoutError{}), true},
+		{"closed keep-alive connection", urlErr(io.EOF), true},
+		{"dns timeout", urlErr(opErr(&net.DNSError{Err: "timeout", IsTimeout: true})), true},
+		{"nxdomain", urlErr(opErr(&net.DNSError{Err: "no such host", IsNotFound: true})), false},
+		{"tls verification", urlErr(x509.UnknownAuthorityError{}), false},
+		{"unsupported scheme", urlErr(errors.New(`unsupported protocol scheme "ftp"`)), false},
+		{"canceled", urlErr(context.Canceled), false},
+		{"object changed", ErrObjectChanged, false},
+	} {
+		if got := DefaultRetryPolicy.retryable(test.err); got != test.want {
+			t.Errorf("%s: retryable(%v) = %v, want %v", test.name, test.err, got, test.want)
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	for header, want := range map[string]time.Duration{
+		"":                              0,
+		"3":                             3 * time.Second,
+		"-1":                            0,
+		"soon":                          0,
+		"Wed, 01 May 2024 12:00:10 GMT": 10 * time.Second,
+		"Wed, 01 May 2024 11:00:00 GMT": 0,
+	} {
+		if got := parseRetryAfter(header, now); got != want {
+			t.Errorf("parseRetryAfter(%q) = %v, want %v", header, got, want)
+		}
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	data := testData(1000)
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		serveData(w, r, data)
+	}))
+	defer srv.Close()
+
+	policy := RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond}
+	r := MakeFetchingReaderWithOptions(srv.URL, Options{HeaderBytes: -1, Retry: &policy})
+	start := time.Now()
+	if _, err := r.ReadAt(make([]byte, 10), 0); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < time.Second {
+		t.Errorf("retried after %v, before the second the server asked for", d)
+	}
+
+	// A wait longer than MaxRetryAfter is not waited for.
+	atomic.StoreInt32(&requests, 0)
+	policy.MaxRetryAfter = 100 * time.Millisecond
+	r = MakeFetchingReaderWithOptions(srv.URL, Options{HeaderBytes: -1, Retry: &policy})
+	var statusErr *StatusError
+	if _, err := r.ReadAt(make([]byte, 10), 0); !errors.As(err, &statusErr) || statusErr.RetryAfter != time.Second {
+		t.Fatalf("got %v, want the 429 asking to retry after a second", err)
+	}
+	if requests != 1 {
+		t.Errorf("sent %d requests, want 1", requests)
+	}
+}
+
+func TestNoRetryOfPermanentErrors(t *testing.T) {
+	// A plain client does not trust the certificate of the test server.
+	var conns int32
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	srv.StartTLS()
+	defer srv.Close()
+
+	policy := RetryPolicy{MaxAttempts: 4, InitialBackoff: time.Millisecond}
+	r := MakeFetchingReaderWithOptions(srv.URL, Options{HeaderBytes: -1, Retry: &policy, Client: &http.Client{}})
+	var certErr *tls.CertificateVerificationError
+	if _, err := r.ReadAt(make([]byte, 10), 0); !errors.As(err, &certErr) {
+		t.Fatalf("got %v, want a certificate verification error", err)
+	}
+	if conns != 1 {
+		t.Errorf("connected %d times, want 1", conns)
+	}
+}
+
+func TestReadAtMultiContext(t *testing.T) {
+	store := newStubStore(t)
+	store.put("/a.tif", testData(100000))
+	store.delay = 5 * time.Second
+	r := MakeFetchingReaderWithOptions(store.url("/a.tif"), Options{HeaderBytes: -1})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	bufs := [][]byte{make([]byte, 10), make([]byte, 10)}
+	if _, err := r.ReadAtMultiContext(ctx, bufs, []int64{100, 50000}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("returned after %v", d)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	data := testData(10000)
+	store := newStubStore(t)
+	store.put("/a.tif", data)
+	policy := &RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond}
+
+	store.fail = []int{http.StatusServiceUnavailable, http.StatusBadGateway}
+	r := MakeFetchingReaderWithOptions(store.url("/a.tif"), Options{HeaderBytes: -1, Retry: policy})
+	checkRead(t, r, data, 0, 100)
+	if n := store.count(); n != 3 {
+		t.Errorf("sent %d requests, want 3", n)
+	}
+
+	// The attempts are used up.
+	store.reset()
+	store.fail = []int{503, 503, 503, 503}
+	r = MakeFetchingReaderWithOptions(store.url("/a.tif"), Options{HeaderBytes: -1, Retry: policy})
+	var statusErr *StatusError
+	if _, err := r.ReadAt(make([]byte, 100), 0); !errors.As(err, &statusErr) || statusErr.Code != 503 {
+		t.Errorf("got %v, want status 503", err)
+	}
+	if n := store.count(); n != 3 {
+		t.Errorf("sent %d requests, want 3", n)
+	}
+
+	// Statuses that will not change are not retried.
+	store.reset()
+	store.fail = []int{http.StatusForbidden}
+	r = MakeFetchingReaderWithOptions(store.url("/a.tif"), Options{HeaderBytes: -1, Retry: policy})
+	if _, err := r.ReadAt(make([]byte, 100), 0); !errors.As(err, &statusErr) || statusErr.Code != http.StatusForbidden {
+		t.Errorf("got %v, want status 403", err)
+	}
+	if n := store.count(); n != 1 {
+		t.Errorf("sent %d requests, want 1", n)
+	}
+}
+
+func TestRetryCancel(t *testing.T) {
+	store := newStubStore(t)
+	store.put("/a.tif", testData(10000))
+	store.fail = []int{503, 503}
+	policy := &RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Hour}
+	r := MakeFetchingReaderWithOptions(store.url("/a.tif"), Options{HeaderBytes: -1, Retry: policy})
+
+	// The backoff is not waited for past the end of the context.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := r.ReadAtContext(ctx, make([]byte, 10), 0); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+	if n := store.count(); n != 1 {
+		t.Errorf("sent %d requests, want 1", n)
+	}
+}
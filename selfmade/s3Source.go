@@ -0,0 +1,194 @@
+package selfmade
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// S3Config tells how to reach an S3-compatible object store.
+type S3Config struct {
+	// Endpoint is the url of the store, e.g. "http://localhost:9000" for a
+	// local MinIO. If empty, AWS S3 in Region is used.
+	Endpoint string
+	// Region is the region requests are signed for. If empty, "us-east-1"
+	// is used, which is also what most other stores expect.
+	Region string
+	// AccessKeyID and SecretAccessKey are the credentials requests are
+	// signed with. If AccessKeyID is empty, requests are sent unsigned.
+	AccessKeyID     string
+	SecretAccessKey string
+	// SessionToken is sent along with temporary credentials.
+	SessionToken string
+	// PathStyle addresses objects as endpoint/bucket/key rather than as
+	// key on a host named after the bucket.
+	PathStyle bool
+}
+
+// S3ConfigFromEnv returns the S3Config described by the usual AWS_*
+// environment variables. Path style is used whenever AWS_ENDPOINT_URL is set.
+func S3ConfigFromEnv() S3Config {
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	return S3Config{
+		Endpoint:        os.Getenv("AWS_ENDPOINT_URL"),
+		Region:          region,
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		PathStyle:       os.Getenv("AWS_ENDPOINT_URL") != "",
+	}
+}
+
+// NewS3Source returns a source reading the object key in bucket with ranged
+// GET requests, signed with AWS Signature Version 4. The PrepareRequest hook
+// of opts, if any, is called before signing. As S3 and compatible stores do
+// not support multi-range requests, several ranges are always asked for one
+// by one.
+func NewS3Source(bucket, key string, cfg S3Config, opts Options) (*HTTPSource, error) {
+	if bucket == "" || key == "" {
+		return nil, errors.New("s3: bucket and key must not be empty")
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	objectUrl, err := cfg.objectURL(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.AccessKeyID != "" {
+		prepare := opts.PrepareRequest
+		opts.PrepareRequest = func(req *http.Request) error {
+			if prepare != nil {
+				if err := prepare(req); err != nil {
+					return err
+				}
+			}
+			cfg.sign(req, time.Now())
+			return nil
+		}
+	}
+	source := NewHTTPSource(objectUrl, opts)
+	source.noMultiRange = true
+	return source, nil
+}
+
+func openS3URL(u *url.URL, opts Options) (RangeSource, error) {
+	return NewS3Source(u.Host, strings.TrimPrefix(u.Path, "/"), S3ConfigFromEnv(), opts)
+}
+
+// objectURL returns the url of key in bucket.
+func (cfg S3Config) objectURL(bucket, key string) (string, error) {
+	endpoint := cfg.Endpoint
+	if endpoint == "" {
+		endpoint = "https://s3." + cfg.Region + ".amazonaws.com"
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	path := "/" + key
+	if cfg.PathStyle {
+		path = "/" + bucket + path
+	} else {
+		u.Host = bucket + "." + u.Host
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + path
+	u.RawPath = s3Escape(u.Path)
+	return u.String(), nil
+}
+
+// s3Escape escapes path the way Signature Version 4 expects for S3: every
+// byte except unreserved characters and slashes is percent-encoded.
+func s3Escape(path string) string {
+	const hexDigits = "0123456789ABCDEF"
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || c == '/' {
+			b.WriteByte(c)
+		} else {
+			b.WriteByte('%')
+			b.WriteByte(hexDigits[c>>4])
+			b.WriteByte(hexDigits[c&15])
+		}
+	}
+	return b.String()
+}
+
+// emptyPayloadHash is the SHA-256 of an empty body, which is all GET and
+// HEAD requests have.
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// sign adds an AWS Signature Version 4 Authorization header to req, which
+// must not have a body. Besides the host, the Range and x-amz-* headers are
+// signed.
+func (cfg S3Config) sign(req *http.Request, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	scope := amzDate[:8] + "/" + cfg.Region + "/s3/aws4_request"
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", emptyPayloadHash)
+	if cfg.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", cfg.SessionToken)
+	}
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if name == "range" || strings.HasPrefix(name, "x-amz-") {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		emptyPayloadHash,
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	signingKey := []byte("AWS4" + cfg.SecretAccessKey)
+	for _, part := range []string{amzDate[:8], cfg.Region, "s3", "aws4_request"} {
+		signingKey = hmacSHA256(signingKey, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+cfg.AccessKeyID+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
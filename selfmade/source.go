@@ -0,0 +1,146 @@
+package selfmade
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sort"
+	"sync"
+)
+
+// RangeSource is where a FetchingReader gets the bytes of a file from.
+// Implementations must be safe for concurrent use.
+type RangeSource interface {
+	// ReadRange returns the n bytes at off, or fewer if the file ends
+	// before, and the version of the file they are from. A range starting at
+	// or beyond the end of the file yields no data and no error. Once the
+	// version is known, ReadRange returns an error wrapping ErrObjectChanged
+	// if the file has changed.
+	ReadRange(ctx context.Context, off int64, n int) ([]byte, string, error)
+	// Size returns the length of the file.
+	Size(ctx context.Context) (int64, error)
+	// Version returns the version of the file seen so far. It is empty if
+	// nothing was read yet or the source cannot tell versions apart.
+	Version() string
+}
+
+// MultiRangeSource is implemented by sources that read several ranges,
+// given as [start, length] pairs, more cheaply at once than one by one.
+type MultiRangeSource interface {
+	RangeSource
+	// ReadRanges is ReadRange for each of ranges. All data is from the same
+	// version of the file, which it returns.
+	ReadRanges(ctx context.Context, ranges [][2]int64) ([][]byte, string, error)
+}
+
+// VersionForgetter is implemented by sources that can be told to accept a
+// new version of the file instead of failing with ErrObjectChanged.
+type VersionForgetter interface {
+	// ForgetVersion makes the next read define the version of the file.
+	ForgetVersion()
+}
+
+// knownSizer is implemented by sources that may know the length of the file
+// without asking for it. knownSize returns -1 if they do not.
+type knownSizer interface {
+	knownSize() int64
+}
+
+func knownSize(source RangeSource) int64 {
+	if sizer, ok := source.(knownSizer); ok {
+		return sizer.knownSize()
+	}
+	return -1
+}
+
+// readRanges reads ranges from source, at once if it is a MultiRangeSource
+// and one by one otherwise.
+func readRanges(ctx context.Context, source RangeSource, ranges [][2]int64) ([][]byte, string, error) {
+	if multi, ok := source.(MultiRangeSource); ok {
+		return multi.ReadRanges(ctx, ranges)
+	}
+	out := make([][]byte, len(ranges))
+	var version string
+	for i, rg := range ranges {
+		data, partVersion, err := source.ReadRange(ctx, rg[0], int(rg[1]))
+		if err != nil {
+			return nil, "", err
+		}
+		if i > 0 && partVersion != version {
+			return nil, "", fmt.Errorf("%w: was %s, now %s", ErrObjectChanged, version, partVersion)
+		}
+		out[i], version = data, partVersion
+	}
+	return out, version, nil
+}
+
+// SourceOpener opens the file at u, configured by opts.
+type SourceOpener func(u *url.URL, opts Options) (RangeSource, error)
+
+var (
+	openersMu sync.RWMutex
+	openers   = map[string]SourceOpener{}
+)
+
+func init() {
+	RegisterScheme("file", openFileURL)
+	RegisterScheme("mem", openMemURL)
+	RegisterScheme("http", openHTTPURL)
+	RegisterScheme("https", openHTTPURL)
+	RegisterScheme("s3", openS3URL)
+}
+
+// RegisterScheme makes OpenSource and Open use open for urls of scheme,
+// replacing any opener registered for it before.
+func RegisterScheme(scheme string, open SourceOpener) {
+	openersMu.Lock()
+	openers[scheme] = open
+	openersMu.Unlock()
+}
+
+// Schemes returns the schemes an opener is registered for, sorted.
+func Schemes() []string {
+	openersMu.RLock()
+	defer openersMu.RUnlock()
+	schemes := make([]string, 0, len(openers))
+	for scheme := range openers {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+	return schemes
+}
+
+// OpenSource opens the file at rawUrl with the opener registered for its
+// scheme. A url without scheme is taken as a local path.
+func OpenSource(rawUrl string, opts Options) (RangeSource, error) {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return nil, err
+	}
+	scheme := u.Scheme
+	if scheme == "" {
+		scheme = "file"
+	}
+	openersMu.RLock()
+	open, ok := openers[scheme]
+	openersMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("no source registered for scheme %q of %s", scheme, rawUrl)
+	}
+	return open(u, opts)
+}
+
+// Open returns a FetchingReader for the file at rawUrl, which may have any
+// scheme registered with RegisterScheme: by default file, mem, http, https
+// and s3.
+func Open(rawUrl string, opts Options) (*FetchingReader, error) {
+	source, err := OpenSource(rawUrl, opts)
+	if err != nil {
+		return nil, err
+	}
+	return MakeFetchingReaderFromSource(rawUrl, source, opts), nil
+}
+
+func openHTTPURL(u *url.URL, opts Options) (RangeSource, error) {
+	return NewHTTPSource(u.String(), opts), nil
+}
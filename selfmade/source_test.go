@@ -0,0 +1,164 @@
+package selfmade
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// checkSource reads ranges of data from r at once and one by one.
+func checkSource(t *testing.T, r *FetchingReader, data []byte) {
+	t.Helper()
+	offs := []int64{30000, 100, int64(len(data)) - 50}
+	bufs := [][]byte{make([]byte, 10), make([]byte, 300), make([]byte, 50)}
+	if _, err := r.ReadAtMulti("", bufs, offs); err != nil {
+		t.Fatalf("ReadAtMulti: %v", err)
+	}
+	for i, off := range offs {
+		if !bytes.Equal(bufs[i], data[off:off+int64(len(bufs[i]))]) {
+			t.Errorf("ReadAtMulti: range at %d holds the wrong data", off)
+		}
+	}
+	checkRead(t, r, data, 20000, 5000)
+	if size, err := r.Size(); err != nil || size != int64(len(data)) {
+		t.Errorf("Size = %d, %v, want %d", size, err, len(data))
+	}
+}
+
+func TestOpen(t *testing.T) {
+	data := testData(50000)
+	path := filepath.Join(t.TempDir(), "a.tif")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	RegisterMemFile("dir/a.tif", data)
+	defer RegisterMemFile("dir/a.tif", nil)
+	store := newStubStore(t)
+	store.put("/a.tif", data)
+
+	for _, u := range []string{
+		path,
+		"file://" + path,
+		"file://localhost" + path,
+		"mem://dir/a.tif",
+		store.url("/a.tif"),
+	} {
+		t.Run(u, func(t *testing.T) {
+			r, err := Open(u, Options{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+			checkSource(t, r, data)
+		})
+	}
+
+	if _, err := OpenSource("file://host"+path, Options{}); err == nil {
+		t.Error("opened a file on another host")
+	}
+	if _, err := Open("mem://missing", Options{}); err == nil {
+		t.Error("opened an unregistered mem file")
+	}
+	if _, err := Open("ftp://host/a.tif", Options{}); err == nil || !strings.Contains(err.Error(), `"ftp"`) {
+		t.Errorf("Open with an unknown scheme: got %v", err)
+	}
+}
+
+func TestOpenS3(t *testing.T) {
+	data := testData(50000)
+	store := newStubStore(t)
+	store.put("/bucket/dir/a b.tif", data)
+	store.signed = true
+	t.Setenv("AWS_ENDPOINT_URL", store.URL)
+	t.Setenv("AWS_ACCESS_KEY_ID", "minio")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "minio123")
+	t.Setenv("AWS_SESSION_TOKEN", "")
+
+	r, err := Open("s3://bucket/dir/a b.tif", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSource(t, r, data)
+
+	// The object is addressed path style, with its key escaped, and the
+	// ranges are asked for one by one.
+	for _, req := range store.log() {
+		if req.Path != "/bucket/dir/a%20b.tif" || strings.Contains(req.Range, ",") {
+			t.Errorf("sent %s %s for %q", req.Method, req.Path, req.Range)
+		}
+		if !strings.HasPrefix(req.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=minio/") {
+			t.Errorf("Authorization = %q", req.Header.Get("Authorization"))
+		}
+	}
+
+	// Without credentials, requests are sent unsigned.
+	t.Setenv("AWS_ACCESS_KEY_ID", "")
+	r, err = Open("s3://bucket/dir/a b.tif", Options{Retry: noRetry})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.ReadAt(make([]byte, 10), 0); err == nil {
+		t.Error("unsigned request was accepted by a store wanting signed ones")
+	}
+	if _, err := Open("s3://bucket", Options{}); err == nil {
+		t.Error("opened an s3 url without key")
+	}
+}
+
+func TestSchemes(t *testing.T) {
+	want := []string{"file", "http", "https", "mem", "s3"}
+	if got := Schemes(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Schemes() = %q, want %q", got, want)
+	}
+
+	data := testData(10000)
+	RegisterScheme("test", func(u *url.URL, opts Options) (RangeSource, error) {
+		return NewMemSource(data), nil
+	})
+	defer func() {
+		openersMu.Lock()
+		delete(openers, "test")
+		openersMu.Unlock()
+	}()
+	r, err := Open("test://a.tif", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRead(t, r, data, 100, 10)
+}
+
+func TestLocalSourceChanged(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "a.tif")
+	if err := os.WriteFile(path, testData(1000), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := OpenLocalSource(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, _, err := s.ReadRange(context.Background(), 0, 10); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(path, testData(2000), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.ReadRange(context.Background(), 0, 10); !errors.Is(err, ErrObjectChanged) {
+		t.Fatalf("got %v, want %v", err, ErrObjectChanged)
+	}
+	s.ForgetVersion()
+	data, _, err := s.ReadRange(context.Background(), 1990, 100)
+	if err != nil || len(data) != 10 {
+		t.Errorf("ReadRange after ForgetVersion = %d bytes, %v, want 10", len(data), err)
+	}
+	if data, _, err := s.ReadRange(context.Background(), 5000, 10); err != nil || len(data) != 0 {
+		t.Errorf("ReadRange beyond the end = %d bytes, %v", len(data), err)
+	}
+}
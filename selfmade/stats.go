@@ -0,0 +1,148 @@
+package selfmade
+
+import (
+	"context"
+	"time"
+)
+
+// Stats is a snapshot of the counters of a FetchingReader. For http, a
+// request is every request sent, including retries, the single-range
+// requests a server without multi-range support needs, and HEAD requests
+// for the size of the file. For other sources, it is one read from the
+// source.
+type Stats struct {
+	Requests       int64
+	FailedRequests int64
+	// BytesFetched counts the bytes received from the source.
+	BytesFetched int64
+	// BytesWasted counts the bytes fetched beyond those the reads causing
+	// the requests asked for: the rest of their blocks, the header prefetch
+	// and the readahead. Later reads may still find them in the cache.
+	BytesWasted int64
+	// CacheHits and CacheMisses count the blocks reads found and did not
+	// find in the cache.
+	CacheHits   int64
+	CacheMisses int64
+	// RequestTime is the time spent in all requests together.
+	RequestTime time.Duration
+}
+
+// RequestEvent describes one request sent to the source of a FetchingReader,
+// as passed to the Observer of its Options.
+type RequestEvent struct {
+	Url string
+	// Ranges are the [start, length] spans of the file asked for. They are
+	// empty for a request for the size of the file only.
+	Ranges   [][2]int64
+	Bytes    int64 // received
+	Wasted   int64 // received but not asked for by any read, see Stats
+	Duration time.Duration
+	Err      error
+}
+
+// Stats returns the current counters of r.
+func (r *FetchingReader) Stats() Stats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.stats
+}
+
+// record counts event and passes it on to the observer.
+func (r *FetchingReader) record(event RequestEvent) {
+	r.mu.Lock()
+	r.stats.Requests++
+	if event.Err != nil {
+		r.stats.FailedRequests++
+	}
+	r.stats.BytesFetched += event.Bytes
+	r.stats.BytesWasted += event.Wasted
+	r.stats.RequestTime += event.Duration
+	r.mu.Unlock()
+
+	if r.observer != nil {
+		r.observer(event)
+	}
+}
+
+// sentRequest is what a source tells about one request it sent.
+type sentRequest struct {
+	ranges   [][2]int64 // asked for
+	received [][2]int64 // [start, length] spans of the data received
+	duration time.Duration
+	err      error
+}
+
+// requestReporter is implemented by sources that tell about every request
+// they send, through the function withRequestObserver puts into the context
+// of a read. Of other sources, each read is taken as one request.
+type requestReporter interface {
+	reportsRequests()
+}
+
+type requestObserverKey struct{}
+
+// withRequestObserver returns ctx carrying observe, which sources
+// implementing requestReporter call with each request they send for ctx.
+func withRequestObserver(ctx context.Context, observe func(sentRequest)) context.Context {
+	return context.WithValue(ctx, requestObserverKey{}, observe)
+}
+
+// reportRequest passes req on to the function in ctx, if any.
+func reportRequest(ctx context.Context, req sentRequest) {
+	if observe, ok := ctx.Value(requestObserverKey{}).(func(sentRequest)); ok {
+		observe(req)
+	}
+}
+
+// observe returns ctx carrying a function recording every request the source
+// of r reports, and whether it reports them at all. want holds the spans of
+// the file the read actually needs, see getDataForKeys.
+func (r *FetchingReader) observe(ctx context.Context, want [][2]int64) (context.Context, bool) {
+	if _, ok := r.source.(requestReporter); !ok {
+		return ctx, false
+	}
+	return withRequestObserver(ctx, func(req sentRequest) {
+		r.record(r.requestEvent(req, want))
+	}), true
+}
+
+// requestEvent returns the event describing req, made for a read needing the
+// spans of want.
+func (r *FetchingReader) requestEvent(req sentRequest, want [][2]int64) RequestEvent {
+	event := RequestEvent{Url: r.fileUrl, Ranges: req.ranges, Duration: req.duration, Err: req.err}
+	for _, rg := range req.received {
+		event.Bytes += rg[1]
+		event.Wasted += rg[1] - overlap(rg[0], rg[1], want)
+	}
+	return event
+}
+
+// overlap returns how many of the n bytes at start lie within any of the
+// [start, length] spans of want, which may overlap each other.
+func overlap(start, n int64, want [][2]int64) int64 {
+	end := start + n
+	var covered int64
+	pos := start
+	for pos < end {
+		// Find the span covering pos that reaches furthest, or else the
+		// next span starting after pos.
+		reach, next := pos, end
+		for _, w := range want {
+			if w[0] <= pos && w[0]+w[1] > reach {
+				reach = w[0] + w[1]
+			} else if w[0] > pos && w[0] < next && w[1] > 0 {
+				next = w[0]
+			}
+		}
+		if reach > pos {
+			if reach > end {
+				reach = end
+			}
+			covered += reach - pos
+			pos = reach
+		} else {
+			pos = next
+		}
+	}
+	return covered
+}
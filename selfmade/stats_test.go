@@ -0,0 +1,103 @@
+package selfmade
+
+import (
+	"net/http"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestOverlap(t *testing.T) {
+	for _, test := range []struct {
+		start, n int64
+		want     [][2]int64
+		covered  int64
+	}{
+		{0, 100, nil, 0},
+		{0, 100, [][2]int64{{10, 20}}, 20},
+		{0, 100, [][2]int64{{10, 20}, {20, 20}, {90, 50}}, 40},
+		{0, 100, [][2]int64{{-10, 20}, {50, 0}}, 10},
+		{100, 100, [][2]int64{{0, 50}, {250, 10}}, 0},
+		{100, 100, [][2]int64{{0, 1000}, {150, 10}}, 100},
+	} {
+		if got := overlap(test.start, test.n, test.want); got != test.covered {
+			t.Errorf("overlap(%d, %d, %v) = %d, want %d", test.start, test.n, test.want, got, test.covered)
+		}
+	}
+}
+
+func TestStatsHTTP(t *testing.T) {
+	data := testData(100000)
+	store := newStubStore(t)
+	store.put("/a.tif", data)
+	var mu sync.Mutex
+	var events []RequestEvent
+	r := MakeFetchingReaderWithOptions(store.url("/a.tif"), Options{
+		HeaderBytes: -1,
+		Retry:       &RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond},
+		Observer: func(event RequestEvent) {
+			mu.Lock()
+			events = append(events, event)
+			mu.Unlock()
+		},
+	})
+
+	checkRead(t, r, data, 100, 10)
+	store.mu.Lock()
+	store.fail = []int{http.StatusServiceUnavailable}
+	store.mu.Unlock()
+	checkRead(t, r, data, 20000, 10) // retried once
+	checkRead(t, r, data, 110, 10)   // from the cache
+
+	// Every request the server saw is counted, the failed one included.
+	got := r.Stats()
+	if got.Requests != int64(store.count()) || got.RequestTime <= 0 {
+		t.Errorf("Stats = %+v after %d requests", got, store.count())
+	}
+	got.RequestTime = 0
+	want := Stats{Requests: 3, FailedRequests: 1, BytesFetched: 8000, BytesWasted: 7980, CacheHits: 1, CacheMisses: 2}
+	if got != want {
+		t.Errorf("Stats = %+v, want %+v", got, want)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(events) != 3 {
+		t.Fatalf("observed %d events, want 3", len(events))
+	}
+	for i, want := range []RequestEvent{
+		{Url: store.url("/a.tif"), Ranges: [][2]int64{{0, 4000}}, Bytes: 4000, Wasted: 3990},
+		{Url: store.url("/a.tif"), Ranges: [][2]int64{{20000, 4000}}},
+		{Url: store.url("/a.tif"), Ranges: [][2]int64{{20000, 4000}}, Bytes: 4000, Wasted: 3990},
+	} {
+		got := events[i]
+		if (got.Err != nil) != (i == 1) {
+			t.Errorf("event %d has error %v", i, got.Err)
+		}
+		got.Err, got.Duration = nil, 0
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("event %d = %+v, want %+v", i, got, want)
+		}
+	}
+}
+
+func TestStatsMemSource(t *testing.T) {
+	data := testData(200000)
+	r := MakeFetchingReaderFromSource("mem://stats", NewMemSource(data), Options{HeaderBytes: -1})
+
+	checkRead(t, r, data, 100, 10)
+	checkRead(t, r, data, 1000, 10)
+	bufs := [][]byte{make([]byte, 10), make([]byte, 10)}
+	if _, err := r.ReadAtMulti("", bufs, []int64{150000, 170000}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each read from the source is one request, however many ranges it has.
+	got := r.Stats()
+	got.RequestTime = 0
+	want := Stats{Requests: 2, BytesFetched: 12000, BytesWasted: 11970, CacheHits: 1, CacheMisses: 3}
+	if got != want {
+		t.Errorf("Stats = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,167 @@
+package selfmade
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testData returns n bytes that differ from their neighbours.
+func testData(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i * 7)
+	}
+	return b
+}
+
+// serveData answers r with data, honouring single and multiple ranges.
+func serveData(w http.ResponseWriter, r *http.Request, data []byte) {
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+}
+
+// How a stubStore answers requests for several ranges.
+const (
+	multipartRanges = iota // with a multipart/byteranges body, as nginx does
+	wholeFile              // with the whole file and status 200, as S3 does
+	firstRange             // with only the first range
+	refuseRanges           // with 416 Range Not Satisfiable
+)
+
+// stubRequest is what a stubStore remembers of a request.
+type stubRequest struct {
+	Method string
+	Path   string
+	Range  string
+	Header http.Header
+}
+
+// stubStore is an http server standing in for an S3-compatible object store
+// such as MinIO, or any other server of static files. It serves the objects
+// put into it under their paths, with an ETag, and honours If-Match.
+type stubStore struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	objects  map[string][]byte
+	requests []stubRequest
+	// multi is how requests for several ranges are answered.
+	multi int
+	// fail lists statuses to answer the next requests with, one each,
+	// before serving normally again.
+	fail []int
+	// delay is waited before answering a request, unless it is cancelled.
+	delay time.Duration
+	// signed makes the store refuse requests without an AWS Signature
+	// Version 4 Authorization header with 403 Forbidden.
+	signed bool
+}
+
+// newStubStore starts a stubStore, which is closed at the end of the test.
+func newStubStore(t *testing.T) *stubStore {
+	s := &stubStore{objects: map[string][]byte{}}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// put stores data as the object at path, replacing the one there before.
+func (s *stubStore) put(path string, data []byte) {
+	s.mu.Lock()
+	s.objects[path] = data
+	s.mu.Unlock()
+}
+
+// url returns the url of the object at path.
+func (s *stubStore) url(path string) string {
+	return s.URL + path
+}
+
+// log returns the requests served so far.
+func (s *stubStore) log() []stubRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]stubRequest(nil), s.requests...)
+}
+
+// count returns how many requests were served so far.
+func (s *stubStore) count() int {
+	return len(s.log())
+}
+
+// ranges returns the Range headers of the GET requests served so far.
+func (s *stubStore) ranges() []string {
+	var ranges []string
+	for _, req := range s.log() {
+		if req.Method == http.MethodGet {
+			ranges = append(ranges, req.Range)
+		}
+	}
+	return ranges
+}
+
+// reset forgets the requests served so far.
+func (s *stubStore) reset() {
+	s.mu.Lock()
+	s.requests = nil
+	s.mu.Unlock()
+}
+
+// etag returns the ETag of data.
+func etag(data []byte) string {
+	sum := sha256.Sum256(data)
+	return `"` + hex.EncodeToString(sum[:8]) + `"`
+}
+
+func (s *stubStore) serve(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requests = append(s.requests, stubRequest{r.Method, r.URL.EscapedPath(), r.Header.Get("Range"), r.Header.Clone()})
+	data, ok := s.objects[r.URL.Path]
+	multi, delay, signed := s.multi, s.delay, s.signed
+	status := 0
+	if len(s.fail) > 0 {
+		status, s.fail = s.fail[0], s.fail[1:]
+	}
+	s.mu.Unlock()
+
+	if delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return
+		}
+	}
+	switch {
+	case status != 0:
+		w.WriteHeader(status)
+		return
+	case signed && !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential="):
+		w.WriteHeader(http.StatusForbidden)
+		return
+	case !ok:
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("ETag", etag(data))
+	if rg := r.Header.Get("Range"); strings.Contains(rg, ",") {
+		switch multi {
+		case wholeFile:
+			r.Header.Del("Range")
+		case firstRange:
+			r.Header.Set("Range", rg[:strings.Index(rg, ",")])
+		case refuseRanges:
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", len(data)))
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+	}
+	serveData(w, r, data)
+}
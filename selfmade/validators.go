@@ -0,0 +1,84 @@
+package selfmade
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// validator identifies one version of a remote file by the ETag and
+// Last-Modified headers the server sends for it.
+type validator struct {
+	etag         string
+	lastModified string
+}
+
+func responseValidator(res *http.Response) validator {
+	return validator{etag: res.Header.Get("ETag"), lastModified: res.Header.Get("Last-Modified")}
+}
+
+// version returns the string identifying v in cache keys.
+func (v validator) version() string {
+	if v.etag != "" {
+		return v.etag
+	}
+	return v.lastModified
+}
+
+// differs reports whether v and other certainly describe different versions.
+func (v validator) differs(other validator) bool {
+	if v.etag != "" && other.etag != "" {
+		return v.etag != other.etag
+	}
+	if v.lastModified != "" && other.lastModified != "" {
+		return v.lastModified != other.lastModified
+	}
+	return false
+}
+
+// setConditions makes req fail with 412 Precondition Failed if the file is
+// no longer the version seen in the first response.
+func (c *HTTPSource) setConditions(req *http.Request) {
+	c.mu.Lock()
+	known := c.known
+	c.mu.Unlock()
+
+	// Weak ETags never match an If-Match, so they are only compared.
+	if known.etag != "" && !strings.HasPrefix(known.etag, "W/") {
+		req.Header.Set("If-Match", known.etag)
+	} else if known.lastModified != "" {
+		req.Header.Set("If-Unmodified-Since", known.lastModified)
+	}
+}
+
+// checkVersion remembers the validators of the first response and returns
+// ErrObjectChanged if those of res differ. It returns the version res is of.
+func (c *HTTPSource) checkVersion(res *http.Response) (string, error) {
+	got := responseValidator(res)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.known == (validator{}) {
+		c.known = got
+	}
+	if c.known.differs(got) {
+		return "", fmt.Errorf("%w: was %s, now %s", ErrObjectChanged, c.known.version(), got.version())
+	}
+	return c.known.version(), nil
+}
+
+// Version returns the version of the file seen so far, if any.
+func (c *HTTPSource) Version() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.known.version()
+}
+
+// ForgetVersion makes the next response define the version of the file, and
+// its size.
+func (c *HTTPSource) ForgetVersion() {
+	c.mu.Lock()
+	c.known = validator{}
+	c.size = -1
+	c.mu.Unlock()
+}
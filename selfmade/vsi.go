@@ -0,0 +1,26 @@
+package selfmade
+
+// VSIReader adapts a FetchingReader to the KeySizerReaderAt and
+// KeyMultiReader interfaces of godal, so that GDAL can read the file through
+// godal.RegisterVSIHandler. Keys are ignored; every key reads the same file.
+type VSIReader struct {
+	r *FetchingReader
+}
+
+// NewVSIReader returns a VSIReader reading through r.
+func NewVSIReader(r *FetchingReader) VSIReader {
+	return VSIReader{r: r}
+}
+
+func (v VSIReader) ReadAt(key string, buf []byte, off int64) (int, error) {
+	return v.r.ReadAt(buf, off)
+}
+
+// Size is used by GDAL as a probe to determine whether the key exists.
+func (v VSIReader) Size(key string) (int64, error) {
+	return v.r.Size()
+}
+
+func (v VSIReader) ReadAtMulti(key string, bufs [][]byte, offs []int64) ([]int, error) {
+	return v.r.ReadAtMulti(key, bufs, offs)
+}
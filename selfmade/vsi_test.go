@@ -0,0 +1,30 @@
+package selfmade
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestVSIReader(t *testing.T) {
+	data := testData(10000)
+	v := NewVSIReader(MakeFetchingReaderFromSource("mem://vsi", NewMemSource(data), Options{}))
+
+	if size, err := v.Size("/vsigs/any"); err != nil || size != int64(len(data)) {
+		t.Errorf("Size = %d, %v, want %d", size, err, len(data))
+	}
+	buf := make([]byte, 100)
+	if n, err := v.ReadAt("/vsigs/any", buf, 5000); err != nil || n != len(buf) || !bytes.Equal(buf, data[5000:5100]) {
+		t.Errorf("ReadAt = %d, %v", n, err)
+	}
+	bufs := [][]byte{make([]byte, 10), make([]byte, 20)}
+	offs := []int64{9000, 10}
+	ns, err := v.ReadAtMulti("/vsigs/any", bufs, offs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, buf := range bufs {
+		if ns[i] != len(buf) || !bytes.Equal(buf, data[offs[i]:offs[i]+int64(len(buf))]) {
+			t.Errorf("ReadAtMulti: range %d holds wrong data", i)
+		}
+	}
+}
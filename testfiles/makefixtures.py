@@ -0,0 +1,313 @@
+#%%
+# Writes the TIFF files in gocog/testdata with libtiff, whose LERC codec is
+# the one GDAL builds its GTiff driver with, together with the samples libtiff
+# decodes from them. Each <name>.tif comes with <name>.raw, holding all
+# samples of the image row by row, pixel-interleaved, in little-endian byte
+# order. Needs libtiff 4.3 or later built with LERC and ZSTD support.
+import ctypes
+import math
+import os
+import struct
+
+tiff = ctypes.CDLL("libtiff.so.6")
+tiff.TIFFOpen.restype = ctypes.c_void_p
+tiff.TIFFOpen.argtypes = [ctypes.c_char_p, ctypes.c_char_p]
+tiff.TIFFClose.argtypes = [ctypes.c_void_p]
+tiff.TIFFWriteEncodedTile.argtypes = [ctypes.c_void_p, ctypes.c_uint32, ctypes.c_char_p, ctypes.c_ssize_t]
+tiff.TIFFReadEncodedTile.argtypes = [ctypes.c_void_p, ctypes.c_uint32, ctypes.c_char_p, ctypes.c_ssize_t]
+tiff.TIFFReadEncodedTile.restype = ctypes.c_ssize_t
+tiff.TIFFWriteEncodedStrip.argtypes = [ctypes.c_void_p, ctypes.c_uint32, ctypes.c_char_p, ctypes.c_ssize_t]
+tiff.TIFFReadEncodedStrip.argtypes = [ctypes.c_void_p, ctypes.c_uint32, ctypes.c_char_p, ctypes.c_ssize_t]
+tiff.TIFFReadEncodedStrip.restype = ctypes.c_ssize_t
+
+outDir = os.path.join(os.path.dirname(os.path.abspath(__file__)), "..", "gocog", "testdata")
+
+WIDTH, HEIGHT, TILE = 50, 40, 32
+
+NONE, LZW, DEFLATE, ZSTD, LERC = 1, 5, 8, 50000, 34887
+LERC_ADD = {"none": 0, "deflate": 1, "zstd": 2}
+
+# struct format, bits per sample and TIFF SampleFormat of each data type.
+TYPES = {
+    "uint8": ("B", 8, 1),
+    "int16": ("h", 16, 2),
+    "uint16": ("H", 16, 1),
+    "int32": ("i", 32, 2),
+    "float32": ("f", 32, 3),
+    "float64": ("d", 64, 3),
+}
+
+
+def setField(tif, tag, *values):
+    args = []
+    for v in values:
+        args.append(ctypes.c_double(v) if isinstance(v, float) else v)
+    if tiff.TIFFSetField(ctypes.c_void_p(tif), ctypes.c_uint32(tag), *args) != 1:
+        raise RuntimeError("cannot set tag %d" % tag)
+
+
+def sample(dtype, band, x, y):
+    """The sample of band at (x, y): a smooth surface with some noise, and
+    NaN in a few places for floating point types."""
+    v = (x * 7 + y * 13 + band * 40 + (x * y) % 5) % 250
+    if dtype == "int16":
+        return v * 100 - 12000
+    if dtype == "uint16":
+        return v * 250
+    if dtype == "int32":
+        return v * 100000 - 9000000
+    if dtype.startswith("float"):
+        if (x + 2 * y) % 17 == 0:
+            return math.nan
+        return 812.5 + v * 0.37 + math.sin(x * 0.3) * 2
+    return v
+
+
+def write(name, dtype, compression, bands=1, alpha=False, predictor=1, lercAdd="none", maxZError=0.0, sparse=(),
+          rowsPerStrip=None, mode="w", planar=1, photometric=None):
+    """Writes testdata/<name>.tif and .raw, in tiles of TILE x TILE pixels or,
+    if rowsPerStrip is set, in strips of that many rows. mode is that of
+    TIFFOpen: "w8" writes BigTIFF, and a "b" big-endian byte order. With
+    planar 2, each band is stored in blocks of its own. photometric defaults
+    to RGB for three bands and to BlackIsZero otherwise. The tiles listed in
+    sparse are left out of the file, which libtiff records with a zero offset
+    and byte count, and read back as zeros."""
+    fmt, bps, sampleFormat = TYPES[dtype]
+    spp = bands + (1 if alpha else 0)
+    path = os.path.join(outDir, name + ".tif").encode()
+    tif = tiff.TIFFOpen(path, mode.encode())
+    setField(tif, 256, WIDTH)
+    setField(tif, 257, HEIGHT)
+    setField(tif, 258, bps)
+    setField(tif, 259, compression)
+    if photometric is None:
+        photometric = 2 if bands == 3 else 1  # RGB or BlackIsZero
+    setField(tif, 262, photometric)
+    setField(tif, 277, spp)
+    setField(tif, 284, planar)  # Contiguous or Separate
+    if rowsPerStrip:
+        setField(tif, 278, rowsPerStrip)
+        blockWidth, blockHeight = WIDTH, rowsPerStrip
+    else:
+        setField(tif, 322, TILE)
+        setField(tif, 323, TILE)
+        blockWidth, blockHeight = TILE, TILE
+    setField(tif, 339, sampleFormat)
+    if alpha:
+        # LERC stores an unassociated alpha band of 8-bit images as its mask.
+        extra = (ctypes.c_uint16 * 1)(2)
+        setField(tif, 338, 1, extra)
+    if predictor != 1:
+        setField(tif, 317, predictor)
+    if compression == LERC:
+        setField(tif, 65565, 4)  # LERC version 2.4
+        setField(tif, 65566, LERC_ADD[lercAdd])
+        setField(tif, 65567, maxZError)
+
+    # Tiles are padded to their full size at the right and bottom edges,
+    # while the last strip holds only the rows left. Each block holds the
+    # samples of the bands listed with it.
+    blocks = []
+    across = (WIDTH + blockWidth - 1) // blockWidth
+    down = (HEIGHT + blockHeight - 1) // blockHeight
+    planes = [range(spp)] if planar == 1 else [[b] for b in range(spp)]
+    for p, plane in enumerate(planes):
+        for by in range(0, HEIGHT, blockHeight):
+            for bx in range(0, WIDTH, blockWidth):
+                rows = min(blockHeight, HEIGHT - by) if rowsPerStrip else blockHeight
+                block = (p * down + by // blockHeight) * across + bx // blockWidth
+                blocks.append((block, bx, by, rows, plane))
+
+    size = struct.calcsize(fmt)
+    for block, bx, by, rows, plane in blocks:
+        if block in sparse:
+            continue
+        values = []
+        for y in range(by, by + rows):
+            for x in range(bx, bx + blockWidth):
+                inside = x < WIDTH and y < HEIGHT
+                for b in plane:
+                    if b < bands:
+                        values.append(sample(dtype, b, x, y) if inside else 0)
+                    else:
+                        values.append(0 if inside and (x * y) % 11 == 3 else 255)
+        data = struct.pack("<%d%s" % (len(values), fmt), *values)
+        writeBlock = tiff.TIFFWriteEncodedStrip if rowsPerStrip else tiff.TIFFWriteEncodedTile
+        if writeBlock(tif, block, data, len(data)) < 0:
+            raise RuntimeError("cannot write block of " + name)
+    tiff.TIFFClose(tif)
+
+    # Read the image back the way libtiff decodes it.
+    tif = tiff.TIFFOpen(path, b"r")
+    pixel = spp * size
+    out = bytearray(WIDTH * HEIGHT * pixel)
+    for block, bx, by, rows, plane in blocks:
+        if block in sparse:
+            continue
+        blockBytes = rows * blockWidth * len(plane) * size
+        buf = ctypes.create_string_buffer(blockBytes)
+        readBlock = tiff.TIFFReadEncodedStrip if rowsPerStrip else tiff.TIFFReadEncodedTile
+        if readBlock(tif, block, buf, blockBytes) != blockBytes:
+            raise RuntimeError("cannot read block of " + name)
+        for y in range(by, min(by + rows, HEIGHT)):
+            for x in range(bx, min(bx + blockWidth, WIDTH)):
+                for i, b in enumerate(plane):
+                    src = (((y - by) * blockWidth + x - bx) * len(plane) + i) * size
+                    dst = (y * WIDTH + x) * pixel + b * size
+                    out[dst:dst + size] = buf.raw[src:src + size]
+    tiff.TIFFClose(tif)
+    with open(os.path.join(outDir, name + ".raw"), "wb") as f:
+        f.write(out)
+
+
+def writePacked(name, bps, photometric=1, colorMap=None, rowsPerStrip=None, mode="w"):
+    """Writes testdata/<name>.tif and .raw for a single band of bps bits, 1, 2,
+    4 or 8, packed into bytes row by row, in tiles or strips as write does.
+    The .raw file holds one byte per sample. colorMap, if given, holds the
+    red, green and blue values of the 1 << bps colors of a paletted image."""
+    path = os.path.join(outDir, name + ".tif").encode()
+    tif = tiff.TIFFOpen(path, mode.encode())
+    setField(tif, 256, WIDTH)
+    setField(tif, 257, HEIGHT)
+    setField(tif, 258, bps)
+    setField(tif, 259, NONE)
+    setField(tif, 262, photometric)
+    setField(tif, 277, 1)
+    if colorMap:
+        n = 1 << bps
+        setField(tif, 320, *[(ctypes.c_uint16 * n)(*colorMap[i * n:(i + 1) * n]) for i in range(3)])
+    if rowsPerStrip:
+        setField(tif, 278, rowsPerStrip)
+        blockWidth, blockHeight = WIDTH, rowsPerStrip
+    else:
+        setField(tif, 322, TILE)
+        setField(tif, 323, TILE)
+        blockWidth, blockHeight = TILE, TILE
+
+    values = [sample("uint8", 0, x, y) % (1 << bps) for y in range(HEIGHT) for x in range(WIDTH)]
+    across = (WIDTH + blockWidth - 1) // blockWidth
+    for by in range(0, HEIGHT, blockHeight):
+        for bx in range(0, WIDTH, blockWidth):
+            rows = min(blockHeight, HEIGHT - by) if rowsPerStrip else blockHeight
+            data = bytearray()
+            for y in range(by, by + rows):
+                row = 0
+                for x in range(bx, bx + blockWidth):
+                    v = values[y * WIDTH + x] if x < WIDTH and y < HEIGHT else 0
+                    row = row << bps | v
+                pad = -blockWidth * bps % 8
+                data += (row << pad).to_bytes((blockWidth * bps + pad) // 8, "big")
+            block = (by // blockHeight) * across + bx // blockWidth
+            writeBlock = tiff.TIFFWriteEncodedStrip if rowsPerStrip else tiff.TIFFWriteEncodedTile
+            if writeBlock(tif, block, bytes(data), len(data)) < 0:
+                raise RuntimeError("cannot write block of " + name)
+    tiff.TIFFClose(tif)
+    with open(os.path.join(outDir, name + ".raw"), "wb") as f:
+        f.write(bytes(values))
+
+
+def writeIFD(name, entries, data):
+    """Writes testdata/<name>.tif by hand, as a little-endian classic TIFF
+    with a single IFD holding entries, (tag, type, values) tuples of SHORT (3)
+    or LONG (4) values, and followed by data. Tags 273 and 279 are added to
+    store data as a single strip. This makes files libtiff would not write."""
+    entries = sorted(entries + [(273, 4, [0]), (279, 4, [len(data)])])
+    ifdSize = 2 + 12 * len(entries) + 4
+    extra = bytearray()
+    fields = []
+    for tag, typ, values in entries:
+        packed = struct.pack("<%d%s" % (len(values), "H" if typ == 3 else "I"), *values)
+        if tag == 273:
+            fields.append(None)  # patched once the position of data is known
+        elif len(packed) <= 4:
+            fields.append(packed.ljust(4, b"\0"))
+        else:
+            fields.append(struct.pack("<I", 8 + ifdSize + len(extra)))
+            extra += packed
+    dataOffset = 8 + ifdSize + len(extra)
+    out = bytearray(b"II*\0" + struct.pack("<I", 8))
+    out += struct.pack("<H", len(entries))
+    for (tag, typ, values), field in zip(entries, fields):
+        if field is None:
+            field = struct.pack("<I", dataOffset)
+        out += struct.pack("<HHI", tag, typ, len(values)) + field
+    out += struct.pack("<I", 0) + extra + data
+    with open(os.path.join(outDir, name + ".tif"), "wb") as f:
+        f.write(out)
+
+
+# %%
+os.makedirs(outDir, exist_ok=True)
+
+write("uint16_none", "uint16", NONE)
+# The tile at the top right is left out, as GDAL does for sparse files.
+write("uint16_sparse", "uint16", NONE, sparse=(1,))
+
+# LERC on its own and with each additional compression, over the data types
+# GDAL writes. The alpha band of the uint8 images and the NaNs of the float
+# images end up in the LERC mask.
+for add, suffix in (("none", "lerc"), ("deflate", "lerc_deflate"), ("zstd", "lerc_zstd")):
+    write("uint8_" + suffix, "uint8", LERC, bands=3, alpha=True, lercAdd=add)
+    for dtype in ("int16", "uint16", "int32", "float32", "float64"):
+        write(dtype + "_" + suffix, dtype, LERC, lercAdd=add)
+write("float32_lerc_lossy", "float32", LERC, maxZError=0.01)
+write("int16_lerc_lossy", "int16", LERC, maxZError=50.0)
+
+# ZSTD, with the horizontal and the floating point predictor.
+write("uint8_zstd", "uint8", ZSTD, bands=3, alpha=True, predictor=2)
+for dtype in ("int16", "uint16", "int32"):
+    write(dtype + "_zstd", dtype, ZSTD, predictor=2)
+for dtype in ("float32", "float64"):
+    write(dtype + "_zstd", dtype, ZSTD, predictor=3)
+
+# Strips: of several rows, the last one shorter than the others, of a single
+# row and a single strip holding the whole image.
+write("uint16_strips", "uint16", NONE, rowsPerStrip=16)
+write("int16_strips_lzw", "int16", LZW, predictor=2, rowsPerStrip=16)
+write("uint8_strips_deflate", "uint8", DEFLATE, bands=3, rowsPerStrip=16)
+write("float32_strips_rows", "float32", NONE, rowsPerStrip=1)
+write("uint16_strip", "uint16", DEFLATE, rowsPerStrip=HEIGHT)
+
+# BigTIFF in both byte orders. The BitsPerSample and SampleFormat of the three
+# bands fit into the 8 bytes of a BigTIFF IFD entry, but not into the 4 of a
+# classic one.
+write("uint16_bigtiff", "uint16", NONE, bands=3, mode="w8")
+write("uint16_bigtiff_be", "uint16", NONE, bands=3, mode="w8b")
+write("int16_bigtiff_be_deflate", "int16", DEFLATE, predictor=2, rowsPerStrip=16, mode="w8b")
+
+# Each band in tiles and in strips of its own.
+write("uint16_planar", "uint16", NONE, bands=3, planar=2)
+write("uint8_planar_strips", "uint8", DEFLATE, bands=3, predictor=2, rowsPerStrip=16, planar=2)
+
+# Without BitsPerSample, which TIFF then takes as 1: a bilevel image, and the
+# samples it holds, one byte each.
+bits = [(x * 3 + y) % 7 < 3 for y in range(HEIGHT) for x in range(WIDTH)]
+packed = bytearray()
+for y in range(HEIGHT):
+    for x in range(0, WIDTH, 8):
+        byte = 0
+        for i in range(8):
+            if x + i < WIDTH and bits[y * WIDTH + x + i]:
+                byte |= 0x80 >> i
+        packed.append(byte)
+writeIFD("bilevel_nobps", [(256, 3, [WIDTH]), (257, 3, [HEIGHT]), (259, 3, [1]), (262, 3, [1]),
+                           (278, 3, [HEIGHT])], bytes(packed))
+with open(os.path.join(outDir, "bilevel_nobps.raw"), "wb") as f:
+    f.write(bytes(bits))
+# BitsPerSample of two samples for an image of three.
+writeIFD("uint8_bps_count", [(256, 3, [WIDTH]), (257, 3, [HEIGHT]), (258, 3, [8, 8]), (259, 3, [1]),
+                             (262, 3, [2]), (277, 3, [3]), (278, 3, [HEIGHT])], bytes(WIDTH * HEIGHT * 3))
+
+# Gray of fewer than 8 bits, also WhiteIsZero, and paletted images.
+writePacked("gray1", 1)
+writePacked("gray2", 2, rowsPerStrip=16)
+writePacked("gray4", 4, rowsPerStrip=7)
+writePacked("gray1_whiteiszero", 1, photometric=0, rowsPerStrip=HEIGHT)
+ramp = lambda n, f: [(i * f) % 65536 for i in range(n)]
+writePacked("palette4", 4, photometric=3, colorMap=ramp(16, 4000) + ramp(16, 2500)[::-1] + ramp(16, 1000))
+writePacked("palette8_be", 8, photometric=3, colorMap=ramp(256, 250) + ramp(256, 97) + ramp(256, 13)[::-1],
+            rowsPerStrip=16, mode="wb")
+# Big-endian images of classic TIFF.
+write("uint16_be", "uint16", NONE, mode="wb")
+write("float32_be_strips", "float32", NONE, rowsPerStrip=16, mode="wb")
+write("uint16_whiteiszero_be", "uint16", NONE, mode="wb", photometric=0)